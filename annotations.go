@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxAnnotationTextLength     = 2048
+	maxAnnotationCategoryLength = 64
+)
+
+func getAnnotationId(r *http.Request) (int, error) {
+	vars := mux.Vars(r)
+	annotationId, err := strconv.Atoi(vars["annotationId"])
+	if err != nil {
+		return annotationId, errors.New("Invalid annotation id: " + vars["annotationId"])
+	}
+
+	return annotationId, err
+}
+
+func parseAnnotation(r *http.Request) (Annotation, error) {
+	decoder := json.NewDecoder(r.Body)
+	var annotation Annotation
+	err := decoder.Decode(&annotation)
+	if err != nil {
+		return Annotation{}, err
+	}
+	defer r.Body.Close()
+
+	report := ValidationReport{Message: "Invalid annotation"}
+	if annotation.Timestamp.IsZero() {
+		report.add("timestamp", "must be specified")
+	}
+	if annotation.EndTime != nil && !annotation.Timestamp.Before(*annotation.EndTime) {
+		report.add("endTime", "must be after timestamp")
+	}
+
+	annotation.Text = strings.TrimSpace(annotation.Text)
+	if annotation.Text == "" {
+		report.add("text", "must be specified")
+	} else if len(annotation.Text) > maxAnnotationTextLength {
+		report.add("text", "must be at most 2048 characters")
+	}
+
+	annotation.Category = strings.ToLower(strings.TrimSpace(annotation.Category))
+	if len(annotation.Category) > maxAnnotationCategoryLength {
+		report.add("category", "must be at most 64 characters")
+	}
+
+	// Image urls end up in the src of an img tag, so only allow web urls
+	annotation.ImageUrl = strings.TrimSpace(annotation.ImageUrl)
+	if annotation.ImageUrl != "" {
+		imageUrl, err := url.Parse(annotation.ImageUrl)
+		if err != nil || (imageUrl.Scheme != "http" && imageUrl.Scheme != "https") || imageUrl.Host == "" {
+			report.add("imageUrl", "must be an http or https url")
+		} else if len(annotation.ImageUrl) > maxAnnotationTextLength {
+			report.add("imageUrl", "must be at most 2048 characters")
+		}
+	}
+
+	if len(report.Problems) > 0 {
+		return Annotation{}, &report
+	}
+
+	annotation.Timestamp = annotation.Timestamp.UTC()
+	if annotation.EndTime != nil {
+		endTime := annotation.EndTime.UTC()
+		annotation.EndTime = &endTime
+	}
+	return annotation, nil
+}
+
+func writeAnnotations(w http.ResponseWriter, db *Database, plotId int, window TimeWindow) {
+	annotations, err := db.getAnnotations(plotId, window)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, _ := json.Marshal(annotations)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+func (env *Env) getAnnotations(w http.ResponseWriter, r *http.Request) {
+	_, plotId, ok := env.checkPlotAccess(w, r, Viewer)
+	if !ok {
+		return
+	}
+
+	writeAnnotations(w, env.db, plotId, TimeWindow{})
+}
+
+// Annotations are read only through share links, and limited to the window
+// of the link.
+func (env *Env) getSharedAnnotations(w http.ResponseWriter, r *http.Request) {
+	shareLink, err := env.getShareLinkFromUuid(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if shareLink == nil {
+		http.Error(w, "No plot found for share link",
+			http.StatusNotFound)
+		return
+	}
+
+	if !env.checkViewerAccess(w, r, shareLink) {
+		return
+	}
+
+	writeAnnotations(w, env.db, shareLink.PlotId, shareLink.window())
+}
+
+func (env *Env) addAnnotation(w http.ResponseWriter, r *http.Request) {
+	user, plotId, ok := env.checkPlotAccess(w, r, Editor)
+	if !ok {
+		return
+	}
+
+	annotation, err := parseAnnotation(r)
+	if err != nil {
+		writeRequestError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	annotation.PlotId = plotId
+	annotation, err = env.db.addAnnotation(annotation, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, _ := json.Marshal(annotation)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonData)
+}
+
+func (env *Env) updateAnnotation(w http.ResponseWriter, r *http.Request) {
+	_, plotId, ok := env.checkPlotAccess(w, r, Editor)
+	if !ok {
+		return
+	}
+
+	annotationId, err := getAnnotationId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	annotation, err := parseAnnotation(r)
+	if err != nil {
+		writeRequestError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// Must use the ids from the url, not the json
+	annotation.Id = annotationId
+	annotation.PlotId = plotId
+	updated, err := env.db.updateAnnotation(annotation)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !updated {
+		http.Error(w, "Annotation not found", http.StatusNotFound)
+		return
+	}
+
+	jsonData, _ := json.Marshal(annotation)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+func (env *Env) removeAnnotation(w http.ResponseWriter, r *http.Request) {
+	_, plotId, ok := env.checkPlotAccess(w, r, Editor)
+	if !ok {
+		return
+	}
+
+	annotationId, err := getAnnotationId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	removed, err := env.db.removeAnnotation(plotId, annotationId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !removed {
+		http.Error(w, "Annotation not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+const autoCloseInterval = 15 * time.Minute
+
+// Decide whether a plot has ended, returning the end time and the reason.
+// Gravity must have stayed within the tolerance for the whole stable
+// period, so a plot needs at least that much gravity data.
+func (policy AutoClosePolicy) endTime(activity PlotActivity) (*time.Time, string) {
+	if policy.StableHours != nil && policy.Tolerance != nil &&
+		activity.FirstGravity != nil && activity.LastGravity != nil && activity.GravityRange != nil {
+		stablePeriod := time.Duration(*policy.StableHours) * time.Hour
+		if activity.LastGravity.Sub(*activity.FirstGravity) >= stablePeriod && *activity.GravityRange <= *policy.Tolerance {
+			return activity.LastGravity, fmt.Sprintf("gravity stable for %d hours", *policy.StableHours)
+		}
+	}
+
+	if policy.IdleDays != nil && activity.LastReading != nil && activity.IdleSeconds != nil {
+		idlePeriod := time.Duration(*policy.IdleDays) * 24 * time.Hour
+		if time.Duration(*activity.IdleSeconds)*time.Second >= idlePeriod {
+			return activity.LastReading, fmt.Sprintf("no data for %d days", *policy.IdleDays)
+		}
+	}
+
+	return nil, ""
+}
+
+func (env *Env) closeFinishedPlots() {
+	plots, err := env.db.getAutoClosePlots()
+	if err != nil {
+		log.Error("Unable to read plots to auto close: " + err.Error())
+		return
+	}
+
+	for _, plot := range plots {
+		stableHours := 0
+		if plot.StableHours != nil {
+			stableHours = *plot.StableHours
+		}
+
+		activity, err := env.db.getPlotActivity(plot.Id, stableHours)
+		if err != nil {
+			log.WithFields(log.Fields{"plot-id": plot.Id}).Error("Unable to read plot activity: " + err.Error())
+			continue
+		}
+
+		endTime, reason := plot.endTime(activity)
+		if endTime == nil {
+			continue
+		}
+
+		ended, err := env.db.endPlot(plot.Id, *endTime)
+		if err != nil {
+			log.WithFields(log.Fields{"plot-id": plot.Id}).Error("Unable to end plot: " + err.Error())
+			continue
+		}
+		if !ended {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"id":       plot.Login,
+			"plot-id":  plot.Id,
+			"end-time": endTime,
+			"reason":   reason,
+		}).Info("Plot ended automatically")
+
+		if plot.Login != "" {
+			err = env.db.addNotification(plot.Login, "Plot "+plot.Name+" ended: "+reason, &plot.Id)
+			if err != nil {
+				log.WithFields(log.Fields{"plot-id": plot.Id}).Error("Unable to notify user: " + err.Error())
+			}
+		}
+	}
+}
+
+func (env *Env) runAutoClose(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		env.closeFinishedPlots()
+	}
+}
+
+func parseAutoClosePolicy(r *http.Request) (AutoClosePolicy, error) {
+	decoder := json.NewDecoder(r.Body)
+	var policy AutoClosePolicy
+	err := decoder.Decode(&policy)
+	if err != nil {
+		return AutoClosePolicy{}, err
+	}
+	defer r.Body.Close()
+
+	if policy.StableHours != nil && *policy.StableHours <= 0 {
+		return AutoClosePolicy{}, errors.New("Invalid policy: stableHours must be positive.")
+	}
+	if (policy.StableHours == nil) != (policy.Tolerance == nil) {
+		return AutoClosePolicy{}, errors.New("Invalid policy: stableHours and tolerance must be specified together.")
+	}
+	if policy.Tolerance != nil && *policy.Tolerance < 0 {
+		return AutoClosePolicy{}, errors.New("Invalid policy: tolerance must not be negative.")
+	}
+	if policy.IdleDays != nil && *policy.IdleDays <= 0 {
+		return AutoClosePolicy{}, errors.New("Invalid policy: idleDays must be positive.")
+	}
+	return policy, nil
+}
+
+func (env *Env) getAutoClosePolicy(w http.ResponseWriter, r *http.Request) {
+	_, plotId, ok := env.checkPlotAccess(w, r, Viewer)
+	if !ok {
+		return
+	}
+
+	policy, err := env.db.getAutoClosePolicy(plotId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, _ := json.Marshal(policy)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+// An empty policy turns auto close off.
+func (env *Env) updateAutoClosePolicy(w http.ResponseWriter, r *http.Request) {
+	_, plotId, ok := env.checkPlotAccess(w, r, Editor)
+	if !ok {
+		return
+	}
+
+	policy, err := parseAutoClosePolicy(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = env.db.setAutoClosePolicy(plotId, policy)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, _ := json.Marshal(policy)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultPlotNameTemplate = "{device} {date}"
+
+// A device whose plot was ended automatically only gets a new plot once its
+// readings have paused this long, as when it is cleaned between batches.
+const autoPlotRestartGap = 12 * time.Hour
+
+// Key suffixes that loggers use for the series of a device, such as
+// tilt_red_temp and tilt_red_grav.
+var instrumentSuffixes = []struct {
+	suffix string
+	kind   string
+}{
+	{"_temperature", "temperature"},
+	{"_temp", "temperature"},
+	{"_gravity", "gravity"},
+	{"_grav", "gravity"},
+	{"_sg", "gravity"},
+}
+
+// Split a measurement key into the device it belongs to and the type of
+// the series, which is empty if the suffix is not recognised.
+func deviceFromKey(key string) (string, string) {
+	for _, s := range instrumentSuffixes {
+		if strings.HasSuffix(key, s.suffix) && len(key) > len(s.suffix) {
+			return strings.TrimSuffix(key, s.suffix), s.kind
+		}
+	}
+	return key, ""
+}
+
+func plotNameFromTemplate(template string, device string, measurement Measurement) string {
+	name := strings.NewReplacer(
+		"{device}", device,
+		"{date}", measurement.Timestamp.Format("2006-01-02"),
+	).Replace(template)
+	name = strings.TrimSpace(name)
+	if len(name) > 255 {
+		name = name[:255]
+	}
+	if name == "" {
+		name = device
+	}
+	return name
+}
+
+// Group the measurements of the uncovered keys by device into new plots,
+// starting each plot at the first reading. Plots are ordered by device.
+func newDevicePlots(rule AutoPlotRule, uncovered []string, measurements []Measurement) ([]string, []Plot) {
+	isUncovered := map[string]bool{}
+	for _, key := range uncovered {
+		isUncovered[key] = true
+	}
+	plots := map[string]*Plot{}
+	seen := map[string]bool{}
+	for _, measurement := range measurements {
+		if !isUncovered[measurement.Key] {
+			continue
+		}
+
+		device, kind := deviceFromKey(measurement.Key)
+		plot, found := plots[device]
+		if !found {
+			plot = &Plot{
+				Name:      plotNameFromTemplate(rule.NameTemplate, device, measurement),
+				StartTime: measurement.Timestamp.Time,
+			}
+			plots[device] = plot
+		}
+		if measurement.Timestamp.Before(plot.StartTime) {
+			plot.StartTime = measurement.Timestamp.Time
+		}
+
+		if !seen[measurement.Key] {
+			seen[measurement.Key] = true
+			if kind == "" {
+				kind = guessInstrumentType(measurement.Value)
+			}
+			plot.Instruments = append(plot.Instruments, Instrument{
+				Key:  measurement.Key,
+				Name: measurement.Key,
+				Type: kind,
+			})
+		}
+	}
+
+	devices := []string{}
+	for device := range plots {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+
+	devicePlots := []Plot{}
+	for _, device := range devices {
+		devicePlots = append(devicePlots, *plots[device])
+	}
+	return devices, devicePlots
+}
+
+// Open a plot for every device in the measurements that has keys no active
+// plot covers, if the user has enabled it. The measurements are already
+// saved, so failures are only logged.
+func (env *Env) autoCreatePlots(user string, measurements []Measurement) {
+	rule, err := env.db.getAutoPlotRule(user)
+	if err != nil {
+		log.WithFields(log.Fields{"id": user}).Error("Unable to read auto plot rule: " + err.Error())
+		return
+	}
+	if !rule.Enabled {
+		return
+	}
+
+	keys := []string{}
+	for _, measurement := range measurements {
+		keys = append(keys, measurement.Key)
+	}
+
+	var devices []string
+	plots, err := env.db.createPlotsForUncoveredKeys(user, keys, func(uncovered []string) []Plot {
+		var plots []Plot
+		devices, plots = newDevicePlots(rule, uncovered, measurements)
+		return plots
+	})
+	if err != nil {
+		log.WithFields(log.Fields{"id": user}).Error("Unable to create plots for new devices: " + err.Error())
+		return
+	}
+
+	for i, plot := range plots {
+		log.WithFields(log.Fields{
+			"id":      user,
+			"plot-id": plot.Id,
+			"device":  devices[i],
+		}).Info("Created plot for new device")
+
+		err = env.db.addNotification(user, "Created plot "+plot.Name+" for new device "+devices[i], &plot.Id)
+		if err != nil {
+			log.WithFields(log.Fields{"id": user, "plot-id": plot.Id}).Error("Unable to notify user: " + err.Error())
+		}
+	}
+}
+
+func parseAutoPlotRule(r *http.Request) (AutoPlotRule, error) {
+	decoder := json.NewDecoder(r.Body)
+	var rule AutoPlotRule
+	err := decoder.Decode(&rule)
+	if err != nil {
+		return AutoPlotRule{}, err
+	}
+	defer r.Body.Close()
+
+	rule.NameTemplate = strings.TrimSpace(rule.NameTemplate)
+	if rule.NameTemplate == "" {
+		rule.NameTemplate = defaultPlotNameTemplate
+	}
+	if len(rule.NameTemplate) > 255 {
+		return AutoPlotRule{}, errors.New("Invalid rule: name template must be at most 255 characters.")
+	}
+	return rule, nil
+}
+
+func (env *Env) getAutoPlotRule(w http.ResponseWriter, r *http.Request) {
+	user, err := getUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rule, err := env.db.getAutoPlotRule(user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, _ := json.Marshal(rule)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+func (env *Env) updateAutoPlotRule(w http.ResponseWriter, r *http.Request) {
+	user, err := getUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rule, err := parseAutoPlotRule(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = env.db.setAutoPlotRule(user, rule)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, _ := json.Marshal(rule)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
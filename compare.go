@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+const maxComparedPlots = 10
+
+func parseComparedPlotIds(r *http.Request) ([]int, error) {
+	vals := r.URL.Query()["plot"]
+	if len(vals) == 0 {
+		return nil, errors.New("At least one plot must be specified")
+	}
+	if len(vals) > maxComparedPlots {
+		return nil, errors.New("At most 10 plots can be compared")
+	}
+
+	plotIds := []int{}
+	seen := map[int]bool{}
+	for _, val := range vals {
+		plotId, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("Invalid plot id: " + val)
+		}
+		if !seen[plotId] {
+			seen[plotId] = true
+			plotIds = append(plotIds, plotId)
+		}
+	}
+	return plotIds, nil
+}
+
+func groupRelativeMeasurements(measurements []RelativeMeasurement) []ComparedSeries {
+	series := []ComparedSeries{}
+	for _, measurement := range measurements {
+		last := len(series) - 1
+		if last < 0 || series[last].PlotId != measurement.PlotId || series[last].Key != measurement.Key {
+			series = append(series, ComparedSeries{
+				PlotId: measurement.PlotId,
+				Name:   measurement.Name,
+				Key:    measurement.Key,
+				Points: []RelativePoint{},
+			})
+			last++
+		}
+		series[last].Points = append(series[last].Points, RelativePoint{
+			Hours: measurement.Hours,
+			Value: measurement.Value,
+		})
+	}
+	return series
+}
+
+// Compare the instruments of one type across plots the user can view, on
+// an axis of hours since the start of each plot.
+func (env *Env) comparePlots(w http.ResponseWriter, r *http.Request) {
+	user, err := getUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	plotIds, err := parseComparedPlotIds(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	instrumentType := r.URL.Query().Get("type")
+	if !instrumentTypes[instrumentType] {
+		http.Error(w, "Type must be temperature or gravity", http.StatusBadRequest)
+		return
+	}
+
+	resolution, err := parseResolution(r)
+	if err != nil {
+		http.Error(w, "Incorrect resolution.", http.StatusBadRequest)
+		return
+	}
+
+	for _, plotId := range plotIds {
+		allowed, err := checkPlotPermission(user, plotId, Viewer, env.db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !allowed {
+			http.Error(w, "User is not allowed to view plot "+strconv.Itoa(plotId),
+				http.StatusForbidden)
+			return
+		}
+	}
+
+	measurements, err := env.db.readRelativeDataFromPlots(plotIds, instrumentType, resolution)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, _ := json.Marshal(groupRelativeMeasurements(measurements))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/pborman/uuid"
 	"github.com/pkg/errors"
 	"net/http"
@@ -14,6 +15,20 @@ type Database struct {
 	db *sqlx.DB
 }
 
+var (
+	ErrUsernameTaken    = errors.New("Username is already taken")
+	ErrInvalidSession   = errors.New("Invalid or expired session")
+	ErrEmailNotVerified = errors.New("Email is not verified")
+)
+
+// Columns for reading a ShareLink
+const shareLinkColumns = `plot_id, uuid, coalesce(label, '') as label, expires_at, window_start,
+        window_end, created_at, views, data_requests, last_accessed, password_hash,
+        password_hash IS NOT NULL as protected`
+
+const plotMetadataColumns = `style, recipe, batch_size, yeast, target_og, target_fg,
+        target_temp_min, target_temp_max, tags, gravity_unit, temperature_unit`
+
 type Resolution int
 
 const (
@@ -78,6 +93,7 @@ func (db *Database) readAllDataFromPlot(plotId int, startTime time.Time, endTime
         SELECT m.key, m.value, m.timestamp
         FROM measurement m, plot p
         WHERE m.timestamp >= p.start_time
+        AND NOT m.excluded
         AND(p.end_time is null OR m.timestamp <= p.end_time)
         AND m.key IN (SELECT key from instruments)
         AND p.id = $1
@@ -89,7 +105,7 @@ func (db *Database) readAllDataFromPlot(plotId int, startTime time.Time, endTime
 	return measurements, err
 }
 
-func (db *Database) readLatestDataFromPlot(plotId int) ([]Measurement, error) {
+func (db *Database) readLatestDataFromPlot(plotId int, window TimeWindow) ([]Measurement, error) {
 	measurements := []Measurement{}
 	var sql = `
         WITH
@@ -103,18 +119,22 @@ func (db *Database) readLatestDataFromPlot(plotId int) ([]Measurement, error) {
             SELECT max(m.timestamp) as timestamp
             FROM measurement m, plot p
             WHERE m.timestamp >= p.start_time
+            AND NOT m.excluded
             AND(p.end_time is null OR m.timestamp <= p.end_time)
+            AND($2::timestamp is null OR m.timestamp >= $2)
+            AND($3::timestamp is null OR m.timestamp <= $3)
             AND p.id = $1
         )
         SELECT m.key, m.value, m.timestamp
         FROM measurement m, plot p
         WHERE m.timestamp >= p.start_time
+        AND NOT m.excluded
         and m.timestamp = (select timestamp from latest_measurement)
         AND m.key IN (SELECT i.keys from instruments i)
         AND p.id = $1
         ORDER BY m.timestamp desc;
     `
-	err := db.db.Select(&measurements, sql, plotId)
+	err := db.db.Select(&measurements, sql, plotId, window.Start, window.End)
 	return measurements, err
 }
 
@@ -153,6 +173,7 @@ func (db *Database) readAggregatedDataFromPlot(plotId int, startTime time.Time,
             round(AVG(m.value)::numeric, 2) as value
         FROM measurement m, plot p, intervals i
         WHERE m.timestamp >= p.start_time
+        AND NOT m.excluded
         AND(p.end_time is null OR m.timestamp <= p.end_time)
         AND m.key IN (SELECT keys from instruments)
         AND p.id = $1
@@ -173,33 +194,237 @@ func (db *Database) readAggregatedDataFromPlot(plotId int, startTime time.Time,
 	return measurements, err
 }
 
-func (db *Database) readMeasurements(user string, name string) ([]Measurement, error) {
-	measurements := []Measurement{}
+// Summarize every instrument of a plot over the same window as
+// readAllDataFromPlot. Without an expected interval, the median interval
+// between readings is used, so the percentage received shows gaps.
+func (db *Database) getPlotSummary(plotId int, expectedInterval *float64) ([]InstrumentSummary, error) {
+	summaries := []InstrumentSummary{}
+	var sql = `
+        WITH readings as (
+            SELECT m.key, m.value, m.timestamp
+            FROM measurement m, plot p
+            WHERE m.timestamp >= p.start_time
+            AND NOT m.excluded
+            AND(p.end_time is null OR m.timestamp <= p.end_time)
+            AND m.key IN (SELECT key FROM instrument WHERE plot = $1)
+            AND p.id = $1
+        ),
+        stats as (
+            SELECT key, count(*) as count, min(value) as min, max(value) as max,
+            avg(value) as mean, stddev_samp(value) as stddev,
+            (array_agg(value ORDER BY timestamp))[1] as first_value,
+            (array_agg(value ORDER BY timestamp DESC))[1] as last_value,
+            min(timestamp) as first_reading, max(timestamp) as last_reading
+            FROM readings
+            GROUP BY key
+        ),
+        gaps as (
+            SELECT key, extract(epoch from timestamp - lag(timestamp) OVER (PARTITION BY key ORDER BY timestamp))::double precision as gap
+            FROM readings
+        ),
+        intervals as (
+            SELECT key, percentile_cont(0.5) WITHIN GROUP (ORDER BY gap) as expected_interval
+            FROM gaps
+            WHERE gap > 0
+            GROUP BY key
+        ),
+        instruments as (
+            SELECT i.id, i.key, coalesce(i.name, '') as name, coalesce(i.type, '') as type,
+            coalesce($2::double precision, iv.expected_interval) as expected_interval,
+            greatest(extract(epoch from least(coalesce(p.end_time, now()), now()) - p.start_time)::double precision, 0) as duration
+            FROM instrument i
+            JOIN plot p ON p.id = i.plot
+            LEFT JOIN intervals iv ON iv.key = i.key
+            WHERE i.plot = $1
+        )
+        SELECT i.key, i.name, i.type, coalesce(s.count, 0) as count, s.min, s.max, s.mean, s.stddev,
+        s.first_value, s.last_value, s.first_reading, s.last_reading, i.expected_interval,
+        CASE WHEN i.expected_interval > 0
+        THEN least(100, 100 * coalesce(s.count, 0) / (i.duration / i.expected_interval + 1))
+        END as received_percent
+        FROM instruments i
+        LEFT JOIN stats s ON s.key = i.key
+        ORDER BY i.id
+    `
+	err := db.db.Select(&summaries, sql, plotId, expectedInterval)
+	return summaries, err
+}
+
+func (resolution Resolution) hours() float64 {
+	switch resolution {
+	case Minute:
+		return 1.0 / 60
+	case Hour:
+		return 1
+	case Day:
+		return 24
+	default:
+		return 0
+	}
+}
+
+// Read the series of one instrument type from several plots, with the time
+// as hours since the start of each plot. Aggregated like
+// readAggregatedDataFromPlot, but in buckets since the plot start.
+func (db *Database) readRelativeDataFromPlots(plotIds []int, instrumentType string, resolution Resolution) ([]RelativeMeasurement, error) {
+	measurements := []RelativeMeasurement{}
+
+	var sql = `
+        WITH relative as (
+            SELECT p.id as plot_id, coalesce(p.name, '') as name, m.key, m.value,
+            extract(epoch from m.timestamp - p.start_time)::double precision / 3600 as hours
+            FROM measurement m, plot p, instrument i
+            WHERE i.plot = p.id
+            AND NOT m.excluded
+            AND m.key = i.key
+            AND i.type = $2
+            AND p.id = ANY($1)
+            AND m.timestamp >= p.start_time
+            AND (p.end_time is null OR m.timestamp <= p.end_time)
+        )
+        SELECT plot_id, name, key,
+        CASE WHEN $3::double precision = 0 THEN hours
+        ELSE floor(hours / $3::double precision) * $3::double precision END as hours,
+        CASE WHEN $3::double precision = 0 THEN AVG(value)
+        ELSE round(AVG(value)::numeric, 2)::double precision END as value
+        FROM relative
+        GROUP BY plot_id, name, key, 4
+        ORDER BY plot_id, key, hours
+    `
+
+	err := db.db.Select(&measurements, sql, pq.Array(plotIds), instrumentType, resolution.hours())
+	return measurements, err
+}
+
+// Read at most limit measurements of a key, oldest first. Without an
+// organization these are the measurements of the user, with one those sent
+// with the keys of the organization.
+func (db *Database) readMeasurements(user string, organizationId *int, key string, start time.Time, end time.Time, limit int) ([]RawMeasurement, error) {
+	measurements := []RawMeasurement{}
 
 	var sql = `
-        SELECT key, value, timestamp
+        SELECT id, key, timestamp, value, excluded
         FROM measurement
-        WHERE name = $1
-        AND login = $2
-        ORDER BY timestamp
+        WHERE ($2::integer IS NULL AND login = $1 OR organization_id = $2)
+        AND key = $3
+        AND timestamp >= $4
+        AND timestamp <= $5
+        ORDER BY timestamp, id
+        LIMIT $6
     `
 
-	err := db.db.Select(&measurements, sql, name, user)
+	err := db.db.Select(&measurements, sql, user, organizationId, key, start, end, limit)
 	return measurements, err
 }
 
-func (db *Database) saveMeasurements(measurements []Measurement, user string) error {
+// Delete the measurements of a key in a time range, recording each of them
+// in the audit table.
+func (db *Database) deleteMeasurements(user string, organizationId *int, key string, start time.Time, end time.Time) (int64, error) {
+	var sql = `
+        WITH deleted AS (
+            DELETE FROM measurement
+            WHERE ($2::integer IS NULL AND login = $1 OR organization_id = $2)
+            AND key = $3
+            AND timestamp >= $4
+            AND timestamp <= $5
+            RETURNING id, organization_id, key, timestamp, value
+        )
+        INSERT INTO measurement_audit (measurement_id, login, organization_id, key, timestamp, action, old_value)
+        SELECT id, $1, organization_id, key, timestamp, 'delete', value
+        FROM deleted
+    `
+
+	result, err := db.db.Exec(sql, user, organizationId, key, start, end)
+	if err != nil {
+		return 0, errors.Wrap(err, "Could not delete measurements")
+	}
+	return result.RowsAffected()
+}
+
+// Correct the value of a measurement, recording the old value in the audit
+// table. Returns nil if the user or organization has no such measurement.
+func (db *Database) updateMeasurement(user string, organizationId *int, measurementId int64, value float64) (*RawMeasurement, error) {
+	tx, err := db.db.Beginx()
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not begin transaction")
+	}
+	defer tx.Rollback()
+
+	var old RawMeasurement
+	err = tx.Get(&old, `
+        SELECT id, key, timestamp, value, excluded
+        FROM measurement
+        WHERE id = $1
+        AND ($3::integer IS NULL AND login = $2 OR organization_id = $3)
+        FOR UPDATE
+    `, measurementId, user, organizationId)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "Could not read measurement")
+	}
+
+	_, err = tx.Exec("UPDATE measurement SET value = $2 WHERE id = $1", measurementId, value)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not update measurement")
+	}
+
+	_, err = tx.Exec(`
+        INSERT INTO measurement_audit (measurement_id, login, organization_id, key, timestamp, action, old_value, new_value)
+        VALUES ($1, $2, $3, $4, $5, 'update', $6, $7)
+    `, old.Id, user, organizationId, old.Key, old.Timestamp, old.Value, value)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not add audit entry")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not commit transaction")
+	}
+
+	old.Value = value
+	return &old, nil
+}
+
+// Get at most limit changes made to the measurements of a user, or of an
+// organization, most recent first. Changes are filtered on the time of the
+// measurement and, if given, its key.
+func (db *Database) getMeasurementAudit(user string, organizationId *int, key string, start time.Time, end time.Time, limit int) ([]MeasurementAudit, error) {
+	entries := []MeasurementAudit{}
+
+	var sql = `
+        SELECT id, measurement_id, login, key, timestamp, action, old_value, new_value, changed_at
+        FROM measurement_audit
+        WHERE ($2::integer IS NULL AND login = $1 AND organization_id IS NULL OR organization_id = $2)
+        AND ($3 = '' OR key = $3)
+        AND timestamp >= $4
+        AND timestamp <= $5
+        ORDER BY changed_at DESC, id DESC
+        LIMIT $6
+    `
+
+	err := db.db.Select(&entries, sql, user, organizationId, key, start, end, limit)
+	return entries, err
+}
+
+// Measurements sent with an organization key belong to the organization
+// rather than to the user that created the key.
+func (db *Database) saveMeasurements(measurements []Measurement, user string, organizationId *int) error {
 	tx, err := db.db.Beginx()
 	if err != nil {
 		return errors.Wrap(err, "Unable to save measurement")
 	}
 
 	var sql = `
-        INSERT INTO measurement (key, value, timestamp, login)
-        VALUES (:key, :value, :timestamp, :login)
+        INSERT INTO measurement (key, value, timestamp, login, organization_id)
+        VALUES (:key, :value, :timestamp, nullif(:login, ''), :organization_id)
     `
 	for _, measurement := range measurements {
 		measurement.Login = user
+		measurement.OrganizationId = organizationId
+		if organizationId != nil {
+			measurement.Login = ""
+		}
 		tx.NamedExec(sql, &measurement)
 	}
 
@@ -210,19 +435,43 @@ func (db *Database) saveMeasurements(measurements []Measurement, user string) er
 	return nil
 }
 
-func (db *Database) getPlots(user string) ([]Plot, error) {
+func (db *Database) getPlots(user string, filter PlotFilter) ([]Plot, error) {
 	plots := []Plot{}
 
 	var sql = `
-        SELECT id, start_time, end_time, name, case when end_time IS null then true else false end as active, s.uuid as sharelink
+        SELECT id, start_time, end_time, name, case when end_time IS null then true else false end as active,
+        (
+            SELECT s.uuid
+            FROM sharelink as s
+            WHERE s.plot_id = plot.id
+            AND (s.expires_at IS NULL OR s.expires_at > now())
+            ORDER BY s.created_at
+            LIMIT 1
+        ) as sharelink,
+        case
+            when plot.login = $1 AND plot.organization_id IS NULL OR 'owner' IN (m.role, om.role) then 'owner'
+            when 'editor' IN (m.role, om.role) then 'editor'
+            else 'viewer'
+        end as role,
+        plot.organization_id, archived, ` + plotMetadataColumns + `
         FROM plot
-        LEFT JOIN sharelink as s
-        ON plot.id = s.plot_id
-        WHERE login = $1
+        LEFT JOIN plot_member as m
+        ON plot.id = m.plot_id AND m.login = $1
+        LEFT JOIN organization_member as om
+        ON plot.organization_id = om.organization_id AND om.login = $1
+        WHERE (plot.login = $1 AND plot.organization_id IS NULL OR m.login = $1 OR om.login = $1)
+        AND ($2::integer IS NULL OR plot.organization_id = $2)
+        AND archived = $3
+        AND tags @> $4::varchar[]
+        AND ($5 = '' OR lower(style) = lower($5))
         ORDER BY start_time DESC
     `
 
-	err := db.db.Select(&plots, sql, user)
+	tags := filter.Tags
+	if tags == nil {
+		tags = pq.StringArray{}
+	}
+	err := db.db.Select(&plots, sql, user, filter.OrganizationId, filter.Archived, tags, filter.Style)
 	return plots, err
 }
 
@@ -233,6 +482,7 @@ func (db *Database) getInstruments(plotId int) ([]Instrument, error) {
         SELECT key, id, name, type
         FROM instrument
         WHERE plot = $1
+        ORDER BY id
     `
 
 	err := db.db.Select(&instruments, sql, plotId)
@@ -243,10 +493,17 @@ func (db *Database) getPlot(id int) (Plot, error) {
 	plot := Plot{}
 
 	var sql = `
-        SELECT id, start_time, end_time, name, case when end_time IS null then true else false end as active, s.uuid as sharelink
+        SELECT id, start_time, end_time, name, case when end_time IS null then true else false end as active,
+        (
+            SELECT s.uuid
+            FROM sharelink as s
+            WHERE s.plot_id = plot.id
+            AND (s.expires_at IS NULL OR s.expires_at > now())
+            ORDER BY s.created_at
+            LIMIT 1
+        ) as sharelink,
+        organization_id, archived, ` + plotMetadataColumns + `
         FROM plot
-        LEFT JOIN sharelink as s
-        ON plot.id = s.plot_id
         WHERE id = $1
     `
 
@@ -254,192 +511,1701 @@ func (db *Database) getPlot(id int) (Plot, error) {
 	return plot, err
 }
 
+// Save a plot with its instruments in one transaction, so that a failure
+// never leaves a plot without instruments.
 func (db *Database) savePlot(plot Plot, user string) (Plot, error) {
+	tx, err := db.db.Beginx()
+	if err != nil {
+		return plot, errors.Wrap(err, "Unable to save plot")
+	}
+	defer tx.Rollback()
 
-	plot.Login = user
+	plot, err = insertPlot(tx, plot, user)
+	if err != nil {
+		return plot, err
+	}
 
-	var sql = `
-        INSERT INTO plot (start_time, end_time, name, login) VALUES (:start_time, :end_time, :name, :login) RETURNING id
-    `
-	var id int
-	rows, err := db.db.NamedQuery(sql, plot)
+	err = tx.Commit()
 	if err != nil {
 		return plot, errors.Wrap(err, "Unable to save plot")
 	}
-	if rows.Next() {
-		rows.Scan(&id)
+	return plot, nil
+}
+
+// Insert a plot with its instruments.
+// Organization plots have no owner but the organization, so only their
+// creator is recorded.
+func insertPlot(q sqlx.Queryer, plot Plot, user string) (Plot, error) {
+	plot.Login = user
+	if plot.OrganizationId != nil {
+		plot.Login = ""
+	}
+	if plot.Tags == nil {
+		plot.Tags = pq.StringArray{}
 	}
-	plot.Id = id
-	tx, err := db.db.Beginx()
-	if err != nil {
-		return plot, errors.Wrap(err, "Unable to save instruments for plot")
+	if plot.GravityUnit == "" {
+		plot.GravityUnit = "sg"
+	}
+	if plot.TemperatureUnit == "" {
+		plot.TemperatureUnit = "C"
 	}
 
-	var sql2 = `
-        INSERT INTO instrument (key, name, type, plot)
-        VALUES (:key, :name, :type, :plot)
+	var sql = `
+        INSERT INTO plot (start_time, end_time, name, login, created_by, organization_id, ` + plotMetadataColumns + `)
+        VALUES ($1, $2, $3, nullif($4, ''), $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+        RETURNING id
     `
-	for _, instrument := range plot.Instruments {
-		instrument.Plot = plot.Id
-		tx.NamedExec(sql2, &instrument)
+	err := q.QueryRowx(sql, plot.StartTime, plot.EndTime, plot.Name, plot.Login, user, plot.OrganizationId,
+		plot.Style, plot.Recipe, plot.BatchSize, plot.Yeast, plot.TargetOG, plot.TargetFG,
+		plot.TargetTempMin, plot.TargetTempMax, plot.Tags, plot.GravityUnit, plot.TemperatureUnit).Scan(&plot.Id)
+	if err != nil {
+		return plot, errors.Wrap(err, "Unable to save plot")
 	}
-	tx.Commit()
-	return plot, err
+
+	for i := range plot.Instruments {
+		plot.Instruments[i], err = insertInstrument(q, plot.Id, plot.Instruments[i])
+		if err != nil {
+			return plot, errors.Wrap(err, "Unable to save instruments for plot")
+		}
+	}
+	return plot, nil
 }
 
+// Update a plot. When the plot has an instrument list, it replaces the
+// instruments of the plot in the same transaction. A new temperature unit
+// converts the fermentation steps to it.
 func (db *Database) updatePlot(plot Plot, user string) (Plot, error) {
 
 	plot.Login = user
 
+	tx, err := db.db.Beginx()
+	if err != nil {
+		return plot, errors.Wrap(err, "Unable to update plot")
+	}
+	defer tx.Rollback()
+
+	if plot.Tags == nil {
+		plot.Tags = pq.StringArray{}
+	}
+
 	var sql = `
-        UPDATE plot SET start_time = :start_time, end_time = :end_time, name = :name WHERE id = :id and login = :login
+        UPDATE plot SET start_time = :start_time, end_time = :end_time, name = :name,
+        style = :style, recipe = :recipe, batch_size = :batch_size, yeast = :yeast,
+        target_og = :target_og, target_fg = :target_fg,
+        target_temp_min = :target_temp_min, target_temp_max = :target_temp_max, tags = :tags,
+        gravity_unit = :gravity_unit, temperature_unit = :temperature_unit
+        WHERE id = :id
     `
-	_, err := db.db.NamedQuery(sql, plot)
+	var temperatureUnit string
+	err = tx.Get(&temperatureUnit, "SELECT temperature_unit FROM plot WHERE id = $1 FOR UPDATE", plot.Id)
+	if err != nil {
+		return plot, errors.Wrap(err, "Unable to update plot")
+	}
+
+	_, err = tx.NamedExec(sql, plot)
 	if err != nil {
 		return plot, err
 	}
+
+	if temperatureUnit != plot.TemperatureUnit {
+		var sqlConvert = `
+            UPDATE fermentation_step
+            SET temperature = temperature * $2 + $3, end_temperature = end_temperature * $2 + $3
+            WHERE plot_id = $1
+        `
+		scale, offset := 9.0/5, 32.0
+		if plot.TemperatureUnit == "C" {
+			scale, offset = 5.0/9, -32.0*5/9
+		}
+		_, err = tx.Exec(sqlConvert, plot.Id, scale, offset)
+		if err != nil {
+			return plot, errors.Wrap(err, "Unable to convert fermentation steps")
+		}
+	}
+
+	if plot.Instruments != nil {
+		_, err = tx.Exec("DELETE FROM instrument WHERE plot = $1", plot.Id)
+		if err != nil {
+			return plot, errors.Wrap(err, "Unable to replace instruments for plot")
+		}
+
+		for i := range plot.Instruments {
+			plot.Instruments[i], err = insertInstrument(tx, plot.Id, plot.Instruments[i])
+			if err != nil {
+				return plot, errors.Wrap(err, "Unable to replace instruments for plot")
+			}
+		}
+	}
+
+	err = tx.Commit()
 	return plot, err
 }
 
-func (db *Database) getUser(r *http.Request) (string, error) {
-	key := r.Header.Get("X-PYTILT-KEY")
-	return db.getUserForKey(key)
+func insertInstrument(q sqlx.Queryer, plotId int, instrument Instrument) (Instrument, error) {
+	instrument.Plot = plotId
+	var sql = `
+        INSERT INTO instrument (key, name, type, plot)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id
+    `
+	err := q.QueryRowx(sql, instrument.Key, instrument.Name, instrument.Type, plotId).Scan(&instrument.Id)
+	return instrument, err
 }
 
-func (db *Database) getUserForKey(key string) (string, error) {
-	var id string
-	err := db.db.Get(&id, "SELECT id FROM login WHERE key = $1", key)
+// Every distinct key measured by the user, and whether it is an instrument
+// of an active plot the user can see.
+func (db *Database) getDiscoveredInstruments(user string) ([]DiscoveredInstrument, error) {
+	instruments := []DiscoveredInstrument{}
 
-	if err == sql.ErrNoRows {
-		return "", errors.New("unknown key")
-	}
-	return id, err
+	var sql = `
+        SELECT m.key, min(m.timestamp) as first_seen, max(m.timestamp) as last_seen, count(*) as count,
+        (array_agg(m.value ORDER BY m.timestamp DESC))[1] as last_value,
+        EXISTS (
+            SELECT 1
+            FROM instrument i, plot p
+            WHERE i.plot = p.id
+            AND i.key = m.key
+            AND (p.end_time IS NULL OR p.end_time > now())
+            AND NOT p.archived
+            AND (
+                p.login = $1
+                OR p.id IN (SELECT plot_id FROM plot_member WHERE login = $1)
+                OR p.organization_id IN (SELECT organization_id FROM organization_member WHERE login = $1)
+            )
+        ) as in_use
+        FROM measurement m
+        WHERE m.login = $1
+        GROUP BY m.key
+        ORDER BY max(m.timestamp) DESC
+    `
+
+	err := db.db.Select(&instruments, sql, user)
+	return instruments, err
 }
 
-func (db *Database) checkIfUserOwnsPlot(user string, plotId int) (bool, error) {
-	var count int
-	err := db.db.Get(&count, "SELECT COUNT(*) FROM plot WHERE login = $1 AND id = $2", user, plotId)
+// The keys that are not an instrument of any active plot the user can see.
+// A device usually keeps sending after its plot was ended automatically, so
+// the keys of such a plot stay covered until the readings pause for a while.
+func getUncoveredKeys(q sqlx.Queryer, user string, keys []string) ([]string, error) {
+	uncovered := []string{}
 
-	if err == sql.ErrNoRows {
-		// No plot with this combination of owner and id exists
-		return false, nil
-	}
+	var sql = `
+        SELECT DISTINCT k.key
+        FROM unnest($2::varchar[]) as k(key)
+        WHERE NOT EXISTS (
+            SELECT 1
+            FROM instrument i, plot p
+            WHERE i.plot = p.id
+            AND i.key = k.key
+            AND NOT p.archived
+            AND (
+                p.login = $1
+                OR p.id IN (SELECT plot_id FROM plot_member WHERE login = $1)
+                OR p.organization_id IN (SELECT organization_id FROM organization_member WHERE login = $1)
+            )
+            AND (
+                p.end_time IS NULL
+                OR p.end_time > now()
+                OR p.auto_closed AND NOT EXISTS (
+                    SELECT 1
+                    FROM (
+                        SELECT m.timestamp - lag(m.timestamp, 1, p.end_time::timestamptz) OVER (ORDER BY m.timestamp) as gap
+                        FROM measurement m
+                        WHERE m.login = $1
+                        AND m.key = k.key
+                        AND m.timestamp > p.end_time
+                    ) as readings
+                    WHERE gap >= $3 * interval '1 second'
+                )
+            )
+        )
+        ORDER BY k.key
+    `
 
-	// There should be only one plot
-	return count == 1, err
+	err := sqlx.Select(q, &uncovered, sql, user, pq.StringArray(keys), autoPlotRestartGap.Seconds())
+	return uncovered, err
 }
 
-func (db *Database) getkeyForUser(user string) (string, error) {
-	var key string
-	err := db.db.Get(&key, "SELECT key FROM login WHERE id = $1", user)
+// Create plots for the keys of the user that no active plot covers. The
+// plots are chosen by newPlots from the uncovered keys. Concurrent calls
+// for the same user are serialized, so that a device gets a single plot.
+func (db *Database) createPlotsForUncoveredKeys(user string, keys []string, newPlots func(uncovered []string) []Plot) ([]Plot, error) {
+	tx, err := db.db.Beginx()
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create plots")
+	}
+	defer tx.Rollback()
 
-	if err == sql.ErrNoRows {
-		return "", errors.New("unknown user")
+	_, err = tx.Exec("SELECT pg_advisory_xact_lock(hashtext('autoplot:' || $1))", user)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create plots")
 	}
-	return key, err
-}
 
-func (db *Database) userExists(id string) (bool, error) {
-	var uid string
-	if err := db.db.QueryRow("SELECT id FROM login WHERE id = $1", id).Scan(&uid); err == nil {
-		return true, nil
-	} else if err == sql.ErrNoRows {
-		return false, nil
-	} else {
-		return false, errors.Wrap(err, "Unable to check if user exists")
+	uncovered, err := getUncoveredKeys(tx, user, keys)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to find keys without plot")
+	}
+	if len(uncovered) == 0 {
+		return nil, nil
 	}
 
-}
+	plots := newPlots(uncovered)
+	for i := range plots {
+		plots[i], err = insertPlot(tx, plots[i], user)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-func (db *Database) createUser(id string, email string, name string) error {
-	tx, error := db.db.Beginx()
-	if error != nil {
-		return errors.New("Unable to connect to database.")
+	err = tx.Commit()
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create plots")
 	}
+	return plots, nil
+}
 
-	key := uuid.New()
+func (db *Database) instrumentKeyInUse(plotId int, key string, instrumentId int) (bool, error) {
+	var inUse bool
 	var sql = `
-        INSERT INTO login (id, name, email, key)
-        VALUES ($1, $2, $3, $4)
+        SELECT EXISTS (SELECT 1 FROM instrument WHERE plot = $1 AND key = $2 AND id != $3)
     `
-	_, error = tx.Exec(sql, id, name, email, key)
-	if error != nil {
-		return errors.New("Unable to create new user")
-	}
-
-	tx.Commit()
-	return nil
+	err := db.db.Get(&inUse, sql, plotId, key, instrumentId)
+	return inUse, err
 }
 
-func (db *Database) addShareLink(plotId int, user string) (ShareLink, error) {
-	shareLink := ShareLink{}
-
-	tx, error := db.db.Beginx()
-	if error != nil {
-		return shareLink, errors.New("Unable to connect to database.")
-	}
+func (db *Database) addInstrument(plotId int, instrument Instrument) (Instrument, error) {
+	return insertInstrument(db.db, plotId, instrument)
+}
 
-	shareLink.PlotId = plotId
-	shareLink.Uuid = uuid.New()
+func (db *Database) updateInstrument(plotId int, instrument Instrument) (bool, error) {
 	var sql = `
-        INSERT INTO sharelink (plot_id, uuid)
-        VALUES ($1, $2)
+        UPDATE instrument SET key = $3, name = $4, type = $5
+        WHERE id = $1 AND plot = $2
     `
-	_, error = tx.Exec(sql, shareLink.PlotId, shareLink.Uuid)
-	if error != nil {
-		return shareLink, errors.New("Unable to create share link")
+	result, err := db.db.Exec(sql, instrument.Id, plotId, instrument.Key, instrument.Name, instrument.Type)
+	if err != nil {
+		return false, err
 	}
+	count, err := result.RowsAffected()
+	return count > 0, err
+}
 
-	tx.Commit()
-	return shareLink, nil
+func (db *Database) removeInstrument(plotId int, instrumentId int) (bool, error) {
+	result, err := db.db.Exec("DELETE FROM instrument WHERE id = $1 AND plot = $2", instrumentId, plotId)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count > 0, err
 }
 
-func (db *Database) getShareLink(plotId int, user string) (*ShareLink, error) {
-	shareLink := ShareLink{}
+func (db *Database) setPlotArchived(plotId int, archived bool) error {
+	_, err := db.db.Exec("UPDATE plot SET archived = $2 WHERE id = $1", plotId, archived)
+	return err
+}
 
-	var sqlSelect = `
-        SELECT plot_id, uuid
-        FROM sharelink
-        WHERE plot_id = $1
+func (db *Database) getAutoClosePolicy(plotId int) (AutoClosePolicy, error) {
+	policy := AutoClosePolicy{}
+	var sql = `
+        SELECT auto_close_stable_hours, auto_close_tolerance, auto_close_idle_days
+        FROM plot
+        WHERE id = $1
     `
+	err := db.db.Get(&policy, sql, plotId)
+	return policy, err
+}
 
-	err := db.db.Get(&shareLink, sqlSelect, plotId)
-	if err == sql.ErrNoRows {
-		return nil, nil
-	}
+func (db *Database) setAutoClosePolicy(plotId int, policy AutoClosePolicy) error {
+	var sql = `
+        UPDATE plot
+        SET auto_close_stable_hours = $2, auto_close_tolerance = $3, auto_close_idle_days = $4
+        WHERE id = $1
+    `
+	_, err := db.db.Exec(sql, plotId, policy.StableHours, policy.Tolerance, policy.IdleDays)
+	return err
+}
 
-	return &shareLink, err
+// Active plots with an auto close policy.
+func (db *Database) getAutoClosePlots() ([]AutoClosePlot, error) {
+	plots := []AutoClosePlot{}
+	var sql = `
+        SELECT id, coalesce(name, '') as name, coalesce(login, created_by, '') as login,
+        auto_close_stable_hours, auto_close_tolerance, auto_close_idle_days
+        FROM plot
+        WHERE end_time IS NULL
+        AND NOT archived
+        AND (auto_close_stable_hours IS NOT NULL OR auto_close_idle_days IS NOT NULL)
+    `
+	err := db.db.Select(&plots, sql)
+	return plots, err
 }
 
-func (db *Database) removeShareLink(plotId int, user string) error {
+// The gravity range is taken over the stable period before the last
+// gravity reading.
+func (db *Database) getPlotActivity(plotId int, stableHours int) (PlotActivity, error) {
+	activity := PlotActivity{}
 	var sql = `
-        DELETE
-        FROM sharelink
-        WHERE plot_id = $1
+        WITH readings as (
+            SELECT m.timestamp, m.value, i.type
+            FROM measurement m, instrument i, plot p
+            WHERE m.key = i.key
+            AND NOT m.excluded
+            AND i.plot = p.id
+            AND p.id = $1
+            AND m.timestamp >= p.start_time
+            AND (m.login = p.login OR m.organization_id = p.organization_id)
+        ),
+        gravity as (
+            SELECT timestamp, value
+            FROM readings
+            WHERE type = 'gravity'
+        )
+        SELECT
+        (SELECT max(timestamp) FROM readings) as last_reading,
+        (SELECT extract(epoch from now() - max(timestamp)) FROM readings) as idle_seconds,
+        (SELECT min(timestamp) FROM gravity) as first_gravity,
+        (SELECT max(timestamp) FROM gravity) as last_gravity,
+        (
+            SELECT max(value) - min(value)
+            FROM gravity
+            WHERE timestamp >= (SELECT max(timestamp) FROM gravity) - $2 * interval '1 hour'
+        ) as gravity_range
     `
-	_, err := db.db.Exec(sql, plotId)
-	return err
+	err := db.db.Get(&activity, sql, plotId, stableHours)
+	return activity, err
 }
 
-func (db *Database) getShareLinkFromUuid(uuidString string) (*ShareLink, error) {
-	// Verify uuid format
-	parsedUuid := uuid.Parse(uuidString)
-	if parsedUuid == nil {
-		return nil, errors.New("Invalid uuid format")
+// End a plot automatically unless someone else already did.
+func (db *Database) endPlot(plotId int, endTime time.Time) (bool, error) {
+	result, err := db.db.Exec("UPDATE plot SET end_time = $2, auto_closed = true WHERE id = $1 AND end_time IS NULL", plotId, endTime)
+	if err != nil {
+		return false, err
 	}
+	count, err := result.RowsAffected()
+	return count > 0, err
+}
 
-	shareLink := ShareLink{}
+// Delete a plot with its instruments and share links. With purge, the
+// measurements shown in the plot are deleted as well, and recorded in the
+// audit table as deleted by the user.
+func (db *Database) deletePlot(plotId int, purge bool, user string) error {
+	tx, err := db.db.Beginx()
+	if err != nil {
+		return errors.New("Unable to connect to database.")
+	}
+	defer tx.Rollback()
+
+	if purge {
+		_, err = tx.Exec(`
+            WITH deleted AS (
+                DELETE
+                FROM measurement m
+                USING plot p
+                WHERE p.id = $1
+                AND m.key IN (SELECT key FROM instrument WHERE plot = $1)
+                AND m.timestamp >= p.start_time
+                AND (p.end_time IS NULL OR m.timestamp <= p.end_time)
+                AND (m.login = p.login OR m.organization_id = p.organization_id)
+                RETURNING m.id, m.organization_id, m.key, m.timestamp, m.value
+            )
+            INSERT INTO measurement_audit (measurement_id, login, organization_id, key, timestamp, action, old_value)
+            SELECT id, $2, organization_id, key, timestamp, 'delete', value
+            FROM deleted
+        `, plotId, user)
+		if err != nil {
+			return errors.Wrap(err, "Unable to delete measurements for plot")
+		}
+	}
 
-	var sqlSelect = `
-        SELECT plot_id, uuid
-        FROM sharelink
-        WHERE uuid = $1
-    `
+	_, err = tx.Exec("UPDATE apikey SET read_plots = array_remove(read_plots, $1) WHERE $1 = ANY(read_plots)", plotId)
+	if err != nil {
+		return errors.Wrap(err, "Unable to delete plot")
+	}
 
-	err := db.db.Get(&shareLink, sqlSelect, uuidString)
-	if err == sql.ErrNoRows {
-		return nil, nil
+	_, err = tx.Exec("DELETE FROM instrument WHERE plot = $1", plotId)
+	if err != nil {
+		return errors.Wrap(err, "Unable to delete instruments for plot")
 	}
 
-	return &shareLink, err
+	// Share links, members, invitations and annotations are removed by cascade
+	_, err = tx.Exec("DELETE FROM plot WHERE id = $1", plotId)
+	if err != nil {
+		return errors.Wrap(err, "Unable to delete plot")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "Unable to delete plot")
+	}
+	return nil
+}
+
+func (db *Database) getUser(r *http.Request) (string, error) {
+	key := r.Header.Get("X-PYTILT-KEY")
+	return db.getUserForKey(key)
+}
+
+func (db *Database) getUserForKey(key string) (string, error) {
+	apiKey, err := db.getApiKey(key)
+	if err != nil {
+		return "", err
+	}
+	return apiKey.Login, nil
+}
+
+func (db *Database) getApiKey(key string) (*ApiKey, error) {
+	apiKey := ApiKey{}
+
+	var sqlSelect = `
+        SELECT id, key, coalesce(name, '') as name, login, write, instrument_patterns, read_plots, organization_id
+        FROM apikey
+        WHERE key = $1
+    `
+	err := db.db.Get(&apiKey, sqlSelect, key)
+	if err == nil {
+		return &apiKey, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	// Not a scoped key: fall back to the unrestricted key stored on the user
+	var id string
+	err = db.db.Get(&id, "SELECT id FROM login WHERE key = $1", key)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("unknown key")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ApiKey{Key: key, Login: id, Write: true}, nil
+}
+
+func (db *Database) getApiKeyById(id int) (*ApiKey, error) {
+	apiKey := ApiKey{}
+
+	var sqlSelect = `
+        SELECT id, key, coalesce(name, '') as name, login, write, instrument_patterns, read_plots, organization_id
+        FROM apikey
+        WHERE id = $1
+    `
+	err := db.db.Get(&apiKey, sqlSelect, id)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("unknown key")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &apiKey, nil
+}
+
+// Remember a nonce used with a key. Returns false if the nonce has been
+// seen before. Nonces older than maxAge can no longer be replayed, since the
+// request timestamp is checked as well, so they are removed.
+func (db *Database) useNonce(keyId int, nonce string, maxAge time.Duration) (bool, error) {
+	_, err := db.db.Exec(`
+        DELETE
+        FROM request_nonce
+        WHERE created_at < now() - $1 * interval '1 second'
+    `, int(maxAge.Seconds()))
+	if err != nil {
+		return false, err
+	}
+
+	var sqlInsert = `
+        INSERT INTO request_nonce (apikey_id, nonce)
+        VALUES ($1, $2)
+        ON CONFLICT DO NOTHING
+    `
+	res, err := db.db.Exec(sqlInsert, keyId, nonce)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count == 1, err
+}
+
+func (db *Database) getApiKeys(user string) ([]ApiKey, error) {
+	apiKeys := []ApiKey{}
+
+	var sql = `
+        SELECT id, key, coalesce(name, '') as name, login, write, instrument_patterns, read_plots, organization_id
+        FROM apikey
+        WHERE login = $1
+        AND organization_id IS NULL
+        ORDER BY id
+    `
+
+	err := db.db.Select(&apiKeys, sql, user)
+	return apiKeys, err
+}
+
+func (db *Database) addApiKey(apiKey ApiKey, user string) (ApiKey, error) {
+	apiKey.Login = user
+	apiKey.Key = uuid.New()
+	if apiKey.InstrumentPatterns == nil {
+		apiKey.InstrumentPatterns = pq.StringArray{}
+	}
+	if apiKey.ReadPlots == nil {
+		apiKey.ReadPlots = pq.Int64Array{}
+	}
+
+	return insertApiKey(db.db, apiKey)
+}
+
+// Takes a Queryer so that keys can also be created within a transaction.
+func insertApiKey(q sqlx.Queryer, apiKey ApiKey) (ApiKey, error) {
+	var sql = `
+        INSERT INTO apikey (login, key, name, write, instrument_patterns, read_plots, organization_id)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        RETURNING id
+    `
+	err := sqlx.Get(q, &apiKey.Id, sql, apiKey.Login, apiKey.Key, apiKey.Name,
+		apiKey.Write, apiKey.InstrumentPatterns, apiKey.ReadPlots, apiKey.OrganizationId)
+	if err != nil {
+		return apiKey, errors.Wrap(err, "Unable to create api key")
+	}
+	return apiKey, nil
+}
+
+func (db *Database) removeApiKey(id int, user string) (bool, error) {
+	var sql = `
+        DELETE
+        FROM apikey
+        WHERE id = $1
+        AND login = $2
+        AND organization_id IS NULL
+    `
+	res, err := db.db.Exec(sql, id, user)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count == 1, err
+}
+
+func (db *Database) getPlotRole(user string, plotId int) (Role, error) {
+	access := []PlotAccess{}
+
+	var sql = `
+        SELECT p.login, p.organization_id, m.role as member_role, om.role as organization_role
+        FROM plot p
+        LEFT JOIN plot_member as m
+        ON p.id = m.plot_id AND m.login = $2
+        LEFT JOIN organization_member as om
+        ON p.organization_id = om.organization_id AND om.login = $2
+        WHERE p.id = $1
+    `
+	err := db.db.Select(&access, sql, plotId, user)
+	if err != nil || len(access) == 0 {
+		return NoRole, err
+	}
+	return access[0].role(user), nil
+}
+
+func (db *Database) getPlotMembers(plotId int) ([]PlotMember, error) {
+	members := []PlotMember{}
+
+	var sql = `
+        SELECT l.id as login, coalesce(l.name, '') as name, coalesce(l.email, '') as email, 'owner' as role
+        FROM plot p, login l
+        WHERE p.login = l.id
+        AND p.id = $1
+        UNION ALL
+        SELECT l.id as login, coalesce(l.name, '') as name, coalesce(l.email, '') as email, m.role
+        FROM plot_member m, login l
+        WHERE m.login = l.id
+        AND m.plot_id = $1
+    `
+	err := db.db.Select(&members, sql, plotId)
+	return members, err
+}
+
+func (db *Database) setPlotMemberRole(plotId int, user string, role Role) (bool, error) {
+	var sql = `
+        UPDATE plot_member
+        SET role = $3
+        WHERE plot_id = $1
+        AND login = $2
+    `
+	res, err := db.db.Exec(sql, plotId, user, role)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count == 1, err
+}
+
+func (db *Database) removePlotMember(plotId int, user string) (bool, error) {
+	var sql = `
+        DELETE
+        FROM plot_member
+        WHERE plot_id = $1
+        AND login = $2
+    `
+	res, err := db.db.Exec(sql, plotId, user)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count == 1, err
+}
+
+// Invite someone to a plot by email. Inviting the same email again replaces
+// the role of the pending invitation.
+func (db *Database) addPlotInvitation(invitation PlotInvitation) (PlotInvitation, error) {
+	var sql = `
+        INSERT INTO plot_invitation (plot_id, email, role, invited_by)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (plot_id, email)
+        DO UPDATE SET role = EXCLUDED.role, invited_by = EXCLUDED.invited_by
+        RETURNING id, created_at
+    `
+	err := db.db.QueryRowx(sql, invitation.PlotId, invitation.Email, invitation.Role,
+		invitation.InvitedBy).Scan(&invitation.Id, &invitation.CreatedAt)
+	if err != nil {
+		return invitation, errors.Wrap(err, "Unable to create invitation")
+	}
+	return invitation, nil
+}
+
+func (db *Database) getPlotInvitations(plotId int) ([]PlotInvitation, error) {
+	invitations := []PlotInvitation{}
+
+	var sql = `
+        SELECT id, plot_id, email, role, invited_by, created_at
+        FROM plot_invitation
+        WHERE plot_id = $1
+        ORDER BY created_at
+    `
+	err := db.db.Select(&invitations, sql, plotId)
+	return invitations, err
+}
+
+func (db *Database) removePlotInvitation(plotId int, id int) (bool, error) {
+	var sql = `
+        DELETE
+        FROM plot_invitation
+        WHERE plot_id = $1
+        AND id = $2
+    `
+	res, err := db.db.Exec(sql, plotId, id)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count == 1, err
+}
+
+func (db *Database) getInvitationsForUser(user string) ([]PlotInvitation, error) {
+	invitations := []PlotInvitation{}
+
+	var sql = `
+        SELECT i.id, i.plot_id, p.name as plot_name, i.email, i.role, i.invited_by, i.created_at
+        FROM plot_invitation i, plot p, login l
+        WHERE i.plot_id = p.id
+        AND lower(i.email) = lower(l.email)
+        AND l.email_verified
+        AND l.id = $1
+        ORDER BY i.created_at
+    `
+	err := db.db.Select(&invitations, sql, user)
+	return invitations, err
+}
+
+// Turn an invitation to the email of the user into a plot membership. Only
+// verified emails are matched, as anyone can sign up with any email.
+// Returns nil if there is no such invitation.
+func (db *Database) acceptInvitation(id int, user string) (*PlotInvitation, error) {
+	tx, err := db.db.Beginx()
+	if err != nil {
+		return nil, errors.New("Unable to connect to database.")
+	}
+	defer tx.Rollback()
+
+	invitation := PlotInvitation{}
+	var sqlDelete = `
+        DELETE
+        FROM plot_invitation i
+        USING login l
+        WHERE lower(i.email) = lower(l.email)
+        AND l.email_verified
+        AND l.id = $2
+        AND i.id = $1
+        RETURNING i.id, i.plot_id, i.email, i.role, i.invited_by, i.created_at
+    `
+	err = tx.Get(&invitation, sqlDelete, id, user)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`
+        INSERT INTO plot_member (plot_id, login, role)
+        SELECT $1, $2, $3
+        WHERE NOT EXISTS (SELECT 1 FROM plot WHERE id = $1 AND login = $2)
+        ON CONFLICT (plot_id, login)
+        DO UPDATE SET role = EXCLUDED.role
+    `, invitation.PlotId, user, invitation.Role)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to accept invitation")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to accept invitation")
+	}
+	return &invitation, nil
+}
+
+func (db *Database) getkeyForUser(user string) (string, error) {
+	var key string
+	err := db.db.Get(&key, "SELECT key FROM login WHERE id = $1", user)
+
+	if err == sql.ErrNoRows {
+		return "", errors.New("unknown user")
+	}
+	return key, err
+}
+
+func (db *Database) userExists(id string) (bool, error) {
+	var uid string
+	if err := db.db.QueryRow("SELECT id FROM login WHERE id = $1", id).Scan(&uid); err == nil {
+		return true, nil
+	} else if err == sql.ErrNoRows {
+		return false, nil
+	} else {
+		return false, errors.Wrap(err, "Unable to check if user exists")
+	}
+
+}
+
+func (db *Database) createUser(id string, email string, emailVerified bool, name string) error {
+	tx, error := db.db.Beginx()
+	if error != nil {
+		return errors.New("Unable to connect to database.")
+	}
+
+	key := uuid.New()
+	var sql = `
+        INSERT INTO login (id, name, email, email_verified, key)
+        VALUES ($1, $2, $3, $4, $5)
+    `
+	_, error = tx.Exec(sql, id, name, email, emailVerified, key)
+	if error != nil {
+		return errors.New("Unable to create new user")
+	}
+
+	tx.Commit()
+	return nil
+}
+
+// Record the email of a user once the issuer has verified it.
+// Whether the email of the user was verified by the token issuer. Emails of
+// local accounts never are.
+func (db *Database) isEmailVerified(user string) (bool, error) {
+	var verified bool
+	err := db.db.Get(&verified, "SELECT email_verified FROM login WHERE id = $1", user)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return verified, err
+}
+
+func (db *Database) setVerifiedEmail(id string, email string) error {
+	var sql = `
+        UPDATE login
+        SET email = $2, email_verified = true
+        WHERE id = $1
+        AND (NOT email_verified OR email IS DISTINCT FROM $2)
+    `
+	_, err := db.db.Exec(sql, id, email)
+	return err
+}
+
+func (db *Database) addShareLink(shareLink ShareLink, plotId int, user string) (ShareLink, error) {
+	tx, error := db.db.Beginx()
+	if error != nil {
+		return shareLink, errors.New("Unable to connect to database.")
+	}
+
+	shareLink.PlotId = plotId
+	shareLink.Uuid = uuid.New()
+	var sql = `
+        INSERT INTO sharelink (plot_id, uuid, label, expires_at, window_start, window_end, password_hash)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        RETURNING created_at
+    `
+	error = tx.Get(&shareLink.CreatedAt, sql, shareLink.PlotId, shareLink.Uuid, shareLink.Label,
+		shareLink.ExpiresAt, shareLink.WindowStart, shareLink.WindowEnd, shareLink.PasswordHash)
+	if error != nil {
+		return shareLink, errors.New("Unable to create share link")
+	}
+
+	tx.Commit()
+	return shareLink, nil
+}
+
+func (db *Database) getShareLink(plotId int, user string) (*ShareLink, error) {
+	shareLink := ShareLink{}
+
+	var sqlSelect = `
+        SELECT ` + shareLinkColumns + `
+        FROM sharelink
+        WHERE plot_id = $1
+        ORDER BY created_at
+        LIMIT 1
+    `
+
+	err := db.db.Get(&shareLink, sqlSelect, plotId)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return &shareLink, err
+}
+
+func (db *Database) getShareLinks(plotId int) ([]ShareLink, error) {
+	shareLinks := []ShareLink{}
+
+	var sqlSelect = `
+        SELECT ` + shareLinkColumns + `
+        FROM sharelink
+        WHERE plot_id = $1
+        ORDER BY created_at
+    `
+
+	err := db.db.Select(&shareLinks, sqlSelect, plotId)
+	return shareLinks, err
+}
+
+func (db *Database) removeShareLink(plotId int, user string) error {
+	var sql = `
+        DELETE
+        FROM sharelink
+        WHERE plot_id = $1
+    `
+	_, err := db.db.Exec(sql, plotId)
+	return err
+}
+
+func (db *Database) removeShareLinkByUuid(plotId int, uuidString string) (bool, error) {
+	var sql = `
+        DELETE
+        FROM sharelink
+        WHERE plot_id = $1
+        AND uuid = $2
+    `
+	res, err := db.db.Exec(sql, plotId, uuidString)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count == 1, err
+}
+
+// Count a visit to a share link, either of the plot itself or of its data.
+func (db *Database) recordShareLinkAccess(uuidString string, dataRequest bool) error {
+	var sql = `
+        UPDATE sharelink
+        SET views = views + 1, last_accessed = now()
+        WHERE uuid = $1
+    `
+	if dataRequest {
+		sql = `
+        UPDATE sharelink
+        SET data_requests = data_requests + 1, last_accessed = now()
+        WHERE uuid = $1
+    `
+	}
+	_, err := db.db.Exec(sql, uuidString)
+	return err
+}
+
+func (db *Database) getShareLinkFromUuid(uuidString string) (*ShareLink, error) {
+	// Verify uuid format
+	parsedUuid := uuid.Parse(uuidString)
+	if parsedUuid == nil {
+		return nil, errors.New("Invalid uuid format")
+	}
+
+	shareLink := ShareLink{}
+
+	var sqlSelect = `
+        SELECT ` + shareLinkColumns + `
+        FROM sharelink
+        WHERE uuid = $1
+        AND (expires_at IS NULL OR expires_at > now())
+    `
+
+	err := db.db.Get(&shareLink, sqlSelect, uuidString)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return &shareLink, err
+}
+
+func (db *Database) createLocalUser(username string, passwordHash string, email string, name string) (string, error) {
+	tx, err := db.db.Beginx()
+	if err != nil {
+		return "", errors.New("Unable to connect to database.")
+	}
+	defer tx.Rollback()
+
+	var count int
+	err = tx.Get(&count, "SELECT COUNT(*) FROM local_credential WHERE username = $1", username)
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to create new user")
+	}
+	if count > 0 {
+		return "", ErrUsernameTaken
+	}
+
+	id := uuid.New()
+	_, err = tx.Exec(`
+        INSERT INTO login (id, name, email, key)
+        VALUES ($1, $2, $3, $4)
+    `, id, name, email, uuid.New())
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to create new user")
+	}
+
+	_, err = tx.Exec(`
+        INSERT INTO local_credential (login, username, password_hash)
+        VALUES ($1, $2, $3)
+    `, id, username, passwordHash)
+	// Someone registered the same username since the check above
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" && pqErr.Constraint == "local_credential_username_key" {
+		return "", ErrUsernameTaken
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to create new user")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to create new user")
+	}
+	return id, nil
+}
+
+func (db *Database) getLocalCredential(username string) (string, string, error) {
+	var credential struct {
+		Login        string `db:"login"`
+		PasswordHash string `db:"password_hash"`
+	}
+
+	var sqlSelect = `
+        SELECT login, password_hash
+        FROM local_credential
+        WHERE username = $1
+    `
+	err := db.db.Get(&credential, sqlSelect, username)
+	return credential.Login, credential.PasswordHash, err
+}
+
+func (db *Database) createSession(id string, user string, refreshHash string, lifetime time.Duration) error {
+	var sql = `
+        INSERT INTO auth_session (id, login, refresh_hash, expires_at)
+        VALUES ($1, $2, $3, now() + $4 * interval '1 second')
+    `
+	_, err := db.db.Exec(sql, id, user, refreshHash, int(lifetime.Seconds()))
+	if err != nil {
+		return errors.Wrap(err, "Unable to create session")
+	}
+	return nil
+}
+
+// Replace the refresh token of an active session. Only succeeds if the old
+// refresh token matches, so each refresh token can be used once.
+func (db *Database) rotateSession(id string, oldRefreshHash string, newRefreshHash string, lifetime time.Duration) (string, error) {
+	var user string
+	var sqlUpdate = `
+        UPDATE auth_session
+        SET refresh_hash = $3, expires_at = now() + $4 * interval '1 second'
+        WHERE id = $1
+        AND refresh_hash = $2
+        AND NOT revoked
+        AND expires_at > now()
+        RETURNING login
+    `
+	err := db.db.Get(&user, sqlUpdate, id, oldRefreshHash, newRefreshHash, int(lifetime.Seconds()))
+	if err == sql.ErrNoRows {
+		return "", ErrInvalidSession
+	}
+	return user, err
+}
+
+func (db *Database) revokeSession(id string, refreshHash string) error {
+	var sqlUpdate = `
+        UPDATE auth_session
+        SET revoked = true
+        WHERE id = $1
+        AND refresh_hash = $2
+    `
+	res, err := db.db.Exec(sqlUpdate, id, refreshHash)
+	if err != nil {
+		return err
+	}
+	count, err := res.RowsAffected()
+	if err == nil && count == 0 {
+		return ErrInvalidSession
+	}
+	return err
+}
+
+func (db *Database) sessionIsActive(id string) (bool, error) {
+	var count int
+	var sqlSelect = `
+        SELECT COUNT(*)
+        FROM auth_session
+        WHERE id = $1
+        AND NOT revoked
+        AND expires_at > now()
+    `
+	err := db.db.Get(&count, sqlSelect, id)
+	return count == 1, err
+}
+
+func (db *Database) createDeviceAuthorization(deviceCodeHash string, userCode string, deviceName string, lifetime time.Duration) error {
+	var sql = `
+        INSERT INTO device_authorization (device_code_hash, user_code, device_name, expires_at)
+        VALUES ($1, $2, $3, now() + $4 * interval '1 second')
+    `
+	_, err := db.db.Exec(sql, deviceCodeHash, userCode, deviceName, int(lifetime.Seconds()))
+	if err != nil {
+		return errors.Wrap(err, "Unable to create device authorization")
+	}
+	return nil
+}
+
+func (db *Database) getPendingDeviceAuthorization(userCode string) (*DeviceAuthorization, error) {
+	authorization := DeviceAuthorization{}
+
+	var sqlSelect = `
+        SELECT user_code, device_name, login, status, false as expired, false as too_fast
+        FROM device_authorization
+        WHERE user_code = $1
+        AND status = 'pending'
+        AND expires_at > now()
+    `
+	err := db.db.Get(&authorization, sqlSelect, userCode)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return &authorization, err
+}
+
+// Approve or deny a pending device authorization on behalf of user.
+func (db *Database) decideDeviceAuthorization(userCode string, user string, approve bool) (bool, error) {
+	status := "denied"
+	if approve {
+		status = "approved"
+	}
+
+	var sql = `
+        UPDATE device_authorization
+        SET status = $3, login = $2
+        WHERE user_code = $1
+        AND status = 'pending'
+        AND expires_at > now()
+    `
+	res, err := db.db.Exec(sql, userCode, user, status)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count == 1, err
+}
+
+// Record a poll from the device. If the authorization has been approved, a
+// new api key is created for the device and returned, and the authorization
+// is marked as issued so that the key is only handed out once.
+func (db *Database) pollDeviceAuthorization(deviceCodeHash string, interval time.Duration) (*DeviceAuthorization, *ApiKey, error) {
+	tx, err := db.db.Beginx()
+	if err != nil {
+		return nil, nil, errors.New("Unable to connect to database.")
+	}
+	defer tx.Rollback()
+
+	authorization := DeviceAuthorization{}
+	var sqlSelect = `
+        SELECT user_code, device_name, login, status,
+            expires_at <= now() as expired,
+            coalesce(last_polled_at > now() - $2 * interval '1 second', false) as too_fast
+        FROM device_authorization
+        WHERE device_code_hash = $1
+        FOR UPDATE
+    `
+	err = tx.Get(&authorization, sqlSelect, deviceCodeHash, int(interval.Seconds()))
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	newStatus := authorization.Status
+	var apiKey *ApiKey
+	if authorization.Status == "approved" && !authorization.Expired {
+		created, err := insertApiKey(tx, ApiKey{
+			Key:                uuid.New(),
+			Name:               authorization.DeviceName,
+			Login:              *authorization.Login,
+			Write:              true,
+			InstrumentPatterns: pq.StringArray{},
+			ReadPlots:          pq.Int64Array{},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		apiKey = &created
+		newStatus = "issued"
+	}
+
+	_, err = tx.Exec(`
+        UPDATE device_authorization
+        SET last_polled_at = now(), status = $2
+        WHERE device_code_hash = $1
+    `, deviceCodeHash, newStatus)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Unable to poll device authorization")
+	}
+	return &authorization, apiKey, nil
+}
+
+func (db *Database) getOrganizations(user string) ([]Organization, error) {
+	organizations := []Organization{}
+
+	var sql = `
+        SELECT o.id, o.name, o.created_at, m.role
+        FROM organization o, organization_member m
+        WHERE o.id = m.organization_id
+        AND m.login = $1
+        ORDER BY o.name
+    `
+	err := db.db.Select(&organizations, sql, user)
+	return organizations, err
+}
+
+func (db *Database) createOrganization(organization Organization, user string) (Organization, error) {
+	tx, err := db.db.Beginx()
+	if err != nil {
+		return organization, errors.New("Unable to connect to database.")
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowx(`
+        INSERT INTO organization (name)
+        VALUES ($1)
+        RETURNING id, created_at
+    `, organization.Name).Scan(&organization.Id, &organization.CreatedAt)
+	if err != nil {
+		return organization, errors.Wrap(err, "Unable to create organization")
+	}
+
+	// The creator is the first owner
+	organization.Role = Owner
+	_, err = tx.Exec(`
+        INSERT INTO organization_member (organization_id, login, role)
+        VALUES ($1, $2, $3)
+    `, organization.Id, user, organization.Role)
+	if err != nil {
+		return organization, errors.Wrap(err, "Unable to create organization")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return organization, errors.Wrap(err, "Unable to create organization")
+	}
+	return organization, nil
+}
+
+func (db *Database) getOrganizationRole(user string, organizationId int) (Role, error) {
+	var role Role
+	err := db.db.Get(&role, "SELECT role FROM organization_member WHERE organization_id = $1 AND login = $2", organizationId, user)
+	if err == sql.ErrNoRows {
+		return NoRole, nil
+	}
+	return role, err
+}
+
+func (db *Database) getOrganizationMembers(organizationId int) ([]PlotMember, error) {
+	members := []PlotMember{}
+
+	var sql = `
+        SELECT l.id as login, coalesce(l.name, '') as name, coalesce(l.email, '') as email, m.role
+        FROM organization_member m, login l
+        WHERE m.login = l.id
+        AND m.organization_id = $1
+        ORDER BY l.name
+    `
+	err := db.db.Select(&members, sql, organizationId)
+	return members, err
+}
+
+// Add the user with the given verified email to the organization, or change
+// the role if already a member. Returns false if there is no such user, and
+// ErrEmailNotVerified if the only users with the email have not verified it.
+func (db *Database) setOrganizationMember(organizationId int, email string, role Role) (bool, error) {
+	var sql = `
+        INSERT INTO organization_member (organization_id, login, role)
+        SELECT $1, id, $3
+        FROM login
+        WHERE lower(email) = lower($2)
+        AND email_verified
+        ON CONFLICT (organization_id, login)
+        DO UPDATE SET role = EXCLUDED.role
+    `
+	res, err := db.db.Exec(sql, organizationId, email, role)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil || count > 0 {
+		return count > 0, err
+	}
+
+	var unverified bool
+	err = db.db.Get(&unverified, "SELECT EXISTS (SELECT 1 FROM login WHERE lower(email) = lower($1))", email)
+	if err != nil {
+		return false, err
+	}
+	if unverified {
+		return false, ErrEmailNotVerified
+	}
+	return false, nil
+}
+
+// The last owner can not be given a lower role.
+func (db *Database) setOrganizationMemberRole(organizationId int, user string, role Role) (bool, error) {
+	var sql = `
+        UPDATE organization_member
+        SET role = $3
+        WHERE organization_id = $1
+        AND login = $2
+        AND ($3 = 'owner' OR role != 'owner' OR (
+            SELECT COUNT(*)
+            FROM organization_member
+            WHERE organization_id = $1
+            AND role = 'owner'
+        ) > 1)
+    `
+	res, err := db.db.Exec(sql, organizationId, user, role)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count == 1, err
+}
+
+// An organization always keeps at least one owner.
+func (db *Database) removeOrganizationMember(organizationId int, user string) (bool, error) {
+	var sql = `
+        DELETE
+        FROM organization_member
+        WHERE organization_id = $1
+        AND login = $2
+        AND (role != 'owner' OR (
+            SELECT COUNT(*)
+            FROM organization_member
+            WHERE organization_id = $1
+            AND role = 'owner'
+        ) > 1)
+    `
+	res, err := db.db.Exec(sql, organizationId, user)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count == 1, err
+}
+
+func (db *Database) getOrganizationApiKeys(organizationId int) ([]ApiKey, error) {
+	apiKeys := []ApiKey{}
+
+	var sql = `
+        SELECT id, key, coalesce(name, '') as name, login, write, instrument_patterns, read_plots, organization_id
+        FROM apikey
+        WHERE organization_id = $1
+        ORDER BY id
+    `
+	err := db.db.Select(&apiKeys, sql, organizationId)
+	return apiKeys, err
+}
+
+func (db *Database) removeOrganizationApiKey(organizationId int, id int) (bool, error) {
+	var sql = `
+        DELETE
+        FROM apikey
+        WHERE id = $1
+        AND organization_id = $2
+    `
+	res, err := db.db.Exec(sql, id, organizationId)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count == 1, err
+}
+
+// Users without a rule get a disabled one with the default template.
+func (db *Database) getAutoPlotRule(user string) (AutoPlotRule, error) {
+	rule := AutoPlotRule{NameTemplate: defaultPlotNameTemplate}
+	var sqlSelect = `
+        SELECT enabled, name_template
+        FROM auto_plot_rule
+        WHERE login = $1
+    `
+	err := db.db.Get(&rule, sqlSelect, user)
+	if err == sql.ErrNoRows {
+		return rule, nil
+	}
+	return rule, err
+}
+
+func (db *Database) setAutoPlotRule(user string, rule AutoPlotRule) error {
+	var sql = `
+        INSERT INTO auto_plot_rule (login, enabled, name_template)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (login)
+        DO UPDATE SET enabled = EXCLUDED.enabled, name_template = EXCLUDED.name_template
+    `
+	_, err := db.db.Exec(sql, user, rule.Enabled, rule.NameTemplate)
+	return err
+}
+
+func (db *Database) addNotification(user string, message string, plotId *int) error {
+	var sql = `
+        INSERT INTO notification (login, message, plot_id)
+        VALUES ($1, $2, $3)
+    `
+	_, err := db.db.Exec(sql, user, message, plotId)
+	return err
+}
+
+func (db *Database) getNotifications(user string, unreadOnly bool) ([]Notification, error) {
+	notifications := []Notification{}
+	var sql = `
+        SELECT id, message, plot_id, created_at, read
+        FROM notification
+        WHERE login = $1
+        AND (NOT $2 OR NOT read)
+        ORDER BY created_at DESC
+        LIMIT 100
+    `
+	err := db.db.Select(&notifications, sql, user, unreadOnly)
+	return notifications, err
+}
+
+func (db *Database) markNotificationRead(user string, id int) (bool, error) {
+	result, err := db.db.Exec("UPDATE notification SET read = true WHERE id = $1 AND login = $2", id, user)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count > 0, err
+}
+
+// Annotations of a plot that overlap the window.
+func (db *Database) getAnnotations(plotId int, window TimeWindow) ([]Annotation, error) {
+	annotations := []Annotation{}
+	var sql = `
+        SELECT id, plot_id, timestamp, end_time, text, category, image_url
+        FROM annotation
+        WHERE plot_id = $1
+        AND ($2::timestamp IS NULL OR coalesce(end_time, timestamp) >= $2)
+        AND ($3::timestamp IS NULL OR timestamp <= $3)
+        ORDER BY timestamp
+    `
+	err := db.db.Select(&annotations, sql, plotId, window.Start, window.End)
+	return annotations, err
+}
+
+func (db *Database) addAnnotation(annotation Annotation, user string) (Annotation, error) {
+	var sql = `
+        INSERT INTO annotation (plot_id, timestamp, end_time, text, category, image_url, created_by)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        RETURNING id
+    `
+	err := db.db.QueryRowx(sql, annotation.PlotId, annotation.Timestamp, annotation.EndTime,
+		annotation.Text, annotation.Category, annotation.ImageUrl, user).Scan(&annotation.Id)
+	return annotation, err
+}
+
+func (db *Database) updateAnnotation(annotation Annotation) (bool, error) {
+	var sql = `
+        UPDATE annotation
+        SET timestamp = $3, end_time = $4, text = $5, category = $6, image_url = $7
+        WHERE id = $1 AND plot_id = $2
+    `
+	result, err := db.db.Exec(sql, annotation.Id, annotation.PlotId, annotation.Timestamp,
+		annotation.EndTime, annotation.Text, annotation.Category, annotation.ImageUrl)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count > 0, err
+}
+
+func (db *Database) removeAnnotation(plotId int, annotationId int) (bool, error) {
+	result, err := db.db.Exec("DELETE FROM annotation WHERE id = $1 AND plot_id = $2", annotationId, plotId)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count > 0, err
+}
+
+func (db *Database) getFermentationSteps(plotId int) ([]FermentationStep, error) {
+	steps := []FermentationStep{}
+	var sql = `
+        SELECT name, temperature, end_temperature, ramp_hours, days
+        FROM fermentation_step
+        WHERE plot_id = $1
+        ORDER BY position
+    `
+	err := db.db.Select(&steps, sql, plotId)
+	return steps, err
+}
+
+// Update the batch metadata of a plot and replace its fermentation steps
+// in one transaction. The plot is read with its steps and locked, changed
+// by apply, and saved unless apply returns an error.
+func (db *Database) saveRecipe(plotId int, apply func(plot *Plot) error) (Plot, error) {
+	plot := Plot{}
+	tx, err := db.db.Beginx()
+	if err != nil {
+		return plot, errors.Wrap(err, "Unable to save recipe")
+	}
+	defer tx.Rollback()
+
+	var sqlSelect = `
+        SELECT id, start_time, end_time, name, case when end_time IS null then true else false end as active,
+        organization_id, archived, ` + plotMetadataColumns + `
+        FROM plot
+        WHERE id = $1
+        FOR UPDATE
+    `
+	err = tx.Get(&plot, sqlSelect, plotId)
+	if err != nil {
+		return plot, errors.Wrap(err, "Unable to read plot")
+	}
+
+	plot.FermentationSteps = []FermentationStep{}
+	err = tx.Select(&plot.FermentationSteps, `
+        SELECT name, temperature, end_temperature, ramp_hours, days
+        FROM fermentation_step
+        WHERE plot_id = $1
+        ORDER BY position
+    `, plotId)
+	if err != nil {
+		return plot, errors.Wrap(err, "Unable to read fermentation steps")
+	}
+
+	err = apply(&plot)
+	if err != nil {
+		return plot, err
+	}
+
+	var sql = `
+        UPDATE plot SET style = $2, recipe = $3, batch_size = $4, yeast = $5,
+        target_og = $6, target_fg = $7, target_temp_min = $8, target_temp_max = $9
+        WHERE id = $1
+    `
+	_, err = tx.Exec(sql, plot.Id, plot.Style, plot.Recipe, plot.BatchSize, plot.Yeast,
+		plot.TargetOG, plot.TargetFG, plot.TargetTempMin, plot.TargetTempMax)
+	if err != nil {
+		return plot, errors.Wrap(err, "Unable to save recipe")
+	}
+
+	err = replaceFermentationSteps(tx, plot.Id, plot.FermentationSteps)
+	if err != nil {
+		return plot, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return plot, errors.Wrap(err, "Unable to save recipe")
+	}
+	return plot, nil
+}
+
+// Create a plot with the fermentation steps of a recipe in one transaction.
+func (db *Database) saveRecipePlot(plot Plot, user string) (Plot, error) {
+	tx, err := db.db.Beginx()
+	if err != nil {
+		return plot, errors.Wrap(err, "Unable to save plot")
+	}
+	defer tx.Rollback()
+
+	plot, err = insertPlot(tx, plot, user)
+	if err != nil {
+		return plot, err
+	}
+
+	err = replaceFermentationSteps(tx, plot.Id, plot.FermentationSteps)
+	if err != nil {
+		return plot, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return plot, errors.Wrap(err, "Unable to save plot")
+	}
+	return plot, nil
+}
+
+func (db *Database) setFermentationSteps(plotId int, steps []FermentationStep) error {
+	tx, err := db.db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "Unable to save fermentation steps")
+	}
+	defer tx.Rollback()
+
+	err = replaceFermentationSteps(tx, plotId, steps)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "Unable to save fermentation steps")
+	}
+	return nil
+}
+
+func replaceFermentationSteps(tx *sqlx.Tx, plotId int, steps []FermentationStep) error {
+	_, err := tx.Exec("DELETE FROM fermentation_step WHERE plot_id = $1", plotId)
+	if err != nil {
+		return errors.Wrap(err, "Unable to save fermentation steps")
+	}
+
+	var sql = `
+        INSERT INTO fermentation_step (plot_id, position, name, temperature, end_temperature, ramp_hours, days)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+    `
+	for i, step := range steps {
+		_, err = tx.Exec(sql, plotId, i, step.Name, step.Temperature, step.EndTemperature, step.RampHours, step.Days)
+		if err != nil {
+			return errors.Wrap(err, "Unable to save fermentation steps")
+		}
+	}
+	return nil
+}
+
+func (db *Database) readExcludedFromPlot(plotId int, startTime time.Time, endTime time.Time) ([]ExcludedReading, error) {
+	readings := []ExcludedReading{}
+	var sql = `
+        SELECT m.key, m.timestamp, m.value, coalesce(m.exclusion_reason, '') as reason
+        FROM measurement m, plot p
+        WHERE m.timestamp >= p.start_time
+        AND m.excluded
+        AND (p.end_time is null OR m.timestamp <= p.end_time)
+        AND m.key IN (SELECT key FROM instrument WHERE plot = $1)
+        AND (m.login = p.login OR m.organization_id = p.organization_id)
+        AND p.id = $1
+        AND m.timestamp >= $2
+        AND m.timestamp <= $3
+        ORDER BY m.timestamp
+    `
+	err := db.db.Select(&readings, sql, plotId, startTime, endTime)
+	return readings, err
+}
+
+// Every reading of a plot sent by its owner, ordered by key and time.
+func (db *Database) readPlotReadings(plotId int) ([]Reading, error) {
+	readings := []Reading{}
+	var sql = `
+        SELECT m.id, m.key, m.value, m.exclusion_reason
+        FROM measurement m, plot p
+        WHERE m.timestamp >= p.start_time
+        AND (p.end_time is null OR m.timestamp <= p.end_time)
+        AND m.key IN (SELECT key FROM instrument WHERE plot = $1)
+        AND (m.login = p.login OR m.organization_id = p.organization_id)
+        AND p.id = $1
+        ORDER BY m.key, m.timestamp
+    `
+	err := db.db.Select(&readings, sql, plotId)
+	return readings, err
+}
+
+// Replace the outlier flags of a plot. Readings excluded or kept by hand
+// are left alone.
+func (db *Database) flagOutliers(plotId int, outlierIds []int64) error {
+	tx, err := db.db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "Unable to flag outliers")
+	}
+	defer tx.Rollback()
+
+	var sqlClear = `
+        UPDATE measurement m
+        SET excluded = false, exclusion_reason = NULL
+        FROM plot p
+        WHERE p.id = $1
+        AND m.exclusion_reason = 'outlier'
+        AND m.key IN (SELECT key FROM instrument WHERE plot = $1)
+        AND (m.login = p.login OR m.organization_id = p.organization_id)
+        AND m.timestamp >= p.start_time
+        AND (p.end_time is null OR m.timestamp <= p.end_time)
+    `
+	_, err = tx.Exec(sqlClear, plotId)
+	if err != nil {
+		return errors.Wrap(err, "Unable to flag outliers")
+	}
+
+	var sqlFlag = `
+        UPDATE measurement
+        SET excluded = true, exclusion_reason = 'outlier'
+        WHERE id = ANY($1)
+        AND exclusion_reason IS NULL
+    `
+	_, err = tx.Exec(sqlFlag, pq.Array(outlierIds))
+	if err != nil {
+		return errors.Wrap(err, "Unable to flag outliers")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "Unable to flag outliers")
+	}
+	return nil
+}
+
+// Exclude or include readings of a plot by hand. Included readings are
+// kept, so that outlier detection does not flag them again.
+func (db *Database) setReadingsExcluded(plotId int, readings []ReadingRef, excluded bool) (int64, error) {
+	keys := pq.StringArray{}
+	timestamps := []string{}
+	for _, reading := range readings {
+		keys = append(keys, reading.Key)
+		timestamps = append(timestamps, reading.Timestamp.Format(time.RFC3339Nano))
+	}
+
+	var sql = `
+        UPDATE measurement m
+        SET excluded = $4, exclusion_reason = CASE WHEN $4 THEN 'manual' ELSE 'kept' END
+        FROM plot p, unnest($2::varchar[], $3::timestamptz[]) as r(key, timestamp)
+        WHERE p.id = $1
+        AND m.key = r.key
+        AND m.timestamp = r.timestamp
+        AND m.key IN (SELECT key FROM instrument WHERE plot = $1)
+        AND (m.login = p.login OR m.organization_id = p.organization_id)
+        AND m.timestamp >= p.start_time
+        AND (p.end_time is null OR m.timestamp <= p.end_time)
+    `
+	result, err := db.db.Exec(sql, plotId, keys, pq.StringArray(timestamps), excluded)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
 }
@@ -0,0 +1,30 @@
+"""31-add_measurement_audit_organization
+
+Revision ID: 0286597e41cf
+Revises: 6214c7d60aa0
+Create Date: 2026-10-19 13:34:33.728677
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = '0286597e41cf'
+down_revision = '6214c7d60aa0'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.execute('''
+        ALTER TABLE measurement_audit ADD COLUMN organization_id int REFERENCES organization (id) ON DELETE CASCADE;
+        CREATE INDEX measurement_audit_organization_idx ON measurement_audit (organization_id, changed_at);
+    ''')
+
+
+def downgrade():
+    op.execute('''
+        DROP INDEX measurement_audit_organization_idx;
+        ALTER TABLE measurement_audit DROP COLUMN organization_id;
+    ''')
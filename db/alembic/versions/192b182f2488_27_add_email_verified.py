@@ -0,0 +1,28 @@
+"""27-add_email_verified
+
+Revision ID: 192b182f2488
+Revises: 8c738a913a64
+Create Date: 2026-10-19 13:15:11.903594
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = '192b182f2488'
+down_revision = '8c738a913a64'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.execute('''
+        ALTER TABLE login ADD COLUMN email_verified boolean NOT NULL DEFAULT false;
+    ''')
+
+
+def downgrade():
+    op.execute('''
+        ALTER TABLE login DROP COLUMN email_verified;
+    ''')
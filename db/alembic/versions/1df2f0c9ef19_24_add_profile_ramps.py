@@ -0,0 +1,28 @@
+"""24-add_profile_ramps
+
+Revision ID: 1df2f0c9ef19
+Revises: 24281f6fa3b1
+Create Date: 2026-10-19 12:59:57.192627
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = '1df2f0c9ef19'
+down_revision = '24281f6fa3b1'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.execute('''
+        ALTER TABLE fermentation_step ADD COLUMN ramp_hours double precision NOT NULL DEFAULT 0;
+    ''')
+
+
+def downgrade():
+    op.execute('''
+        ALTER TABLE fermentation_step DROP COLUMN ramp_hours;
+    ''')
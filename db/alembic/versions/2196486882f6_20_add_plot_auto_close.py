@@ -0,0 +1,32 @@
+"""20-add_plot_auto_close
+
+Revision ID: 2196486882f6
+Revises: ff958115f039
+Create Date: 2026-10-19 12:55:12.225282
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = '2196486882f6'
+down_revision = 'ff958115f039'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.execute('''
+        ALTER TABLE plot ADD COLUMN auto_close_stable_hours int;
+        ALTER TABLE plot ADD COLUMN auto_close_tolerance double precision;
+        ALTER TABLE plot ADD COLUMN auto_close_idle_days int;
+    ''')
+
+
+def downgrade():
+    op.execute('''
+        ALTER TABLE plot DROP COLUMN auto_close_stable_hours;
+        ALTER TABLE plot DROP COLUMN auto_close_tolerance;
+        ALTER TABLE plot DROP COLUMN auto_close_idle_days;
+    ''')
@@ -0,0 +1,37 @@
+"""23-add_fermentation_steps
+
+Revision ID: 24281f6fa3b1
+Revises: cea3673da545
+Create Date: 2026-10-19 12:57:56.456798
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = '24281f6fa3b1'
+down_revision = 'cea3673da545'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.execute('''
+        CREATE TABLE fermentation_step (
+            id serial PRIMARY KEY,
+            plot_id int NOT NULL REFERENCES plot (id) ON DELETE CASCADE,
+            position int NOT NULL,
+            name varchar(255) NOT NULL DEFAULT '',
+            temperature double precision NOT NULL,
+            end_temperature double precision,
+            days double precision NOT NULL,
+            UNIQUE (plot_id, position)
+        );
+    ''')
+
+
+def downgrade():
+    op.execute('''
+        DROP TABLE fermentation_step;
+    ''')
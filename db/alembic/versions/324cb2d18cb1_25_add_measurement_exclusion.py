@@ -0,0 +1,30 @@
+"""25-add_measurement_exclusion
+
+Revision ID: 324cb2d18cb1
+Revises: 1df2f0c9ef19
+Create Date: 2026-10-19 13:02:11.352385
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = '324cb2d18cb1'
+down_revision = '1df2f0c9ef19'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.execute('''
+        ALTER TABLE measurement ADD COLUMN excluded boolean NOT NULL DEFAULT false;
+        ALTER TABLE measurement ADD COLUMN exclusion_reason varchar(16);
+    ''')
+
+
+def downgrade():
+    op.execute('''
+        ALTER TABLE measurement DROP COLUMN excluded;
+        ALTER TABLE measurement DROP COLUMN exclusion_reason;
+    ''')
@@ -0,0 +1,45 @@
+"""10-add_local_auth
+
+Revision ID: 47162dcd8db5
+Revises: ca6f4bc2b70b
+Create Date: 2026-10-19 12:40:35.442978
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = '47162dcd8db5'
+down_revision = 'ca6f4bc2b70b'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.execute('''
+    CREATE TABLE local_credential (
+        login varchar(255) PRIMARY KEY REFERENCES login (id) ON DELETE CASCADE,
+        username varchar(255) UNIQUE NOT NULL,
+        password_hash varchar(255) NOT NULL
+    );
+    ''')
+    op.execute('''
+    CREATE TABLE auth_session (
+        id varchar(255) PRIMARY KEY,
+        login varchar(255) NOT NULL REFERENCES login (id) ON DELETE CASCADE,
+        refresh_hash varchar(255) NOT NULL,
+        created_at timestamp NOT NULL DEFAULT now(),
+        expires_at timestamp NOT NULL,
+        revoked boolean NOT NULL DEFAULT false
+    );
+    ''')
+
+
+def downgrade():
+    op.execute('''
+    DROP TABLE auth_session
+    ''')
+    op.execute('''
+    DROP TABLE local_credential
+    ''')
@@ -0,0 +1,28 @@
+"""28-add_plot_auto_closed
+
+Revision ID: 47a7355f8d82
+Revises: 192b182f2488
+Create Date: 2026-10-19 13:17:39.005858
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = '47a7355f8d82'
+down_revision = '192b182f2488'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.execute('''
+        ALTER TABLE plot ADD COLUMN auto_closed boolean NOT NULL DEFAULT false;
+    ''')
+
+
+def downgrade():
+    op.execute('''
+        ALTER TABLE plot DROP COLUMN auto_closed;
+    ''')
@@ -0,0 +1,28 @@
+"""18-add_plot_archived
+
+Revision ID: 47b2a153c6b4
+Revises: 843aa4756128
+Create Date: 2026-10-19 12:48:58.403561
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = '47b2a153c6b4'
+down_revision = '843aa4756128'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.execute('''
+        ALTER TABLE plot ADD COLUMN archived boolean NOT NULL DEFAULT false;
+    ''')
+
+
+def downgrade():
+    op.execute('''
+        ALTER TABLE plot DROP COLUMN archived;
+    ''')
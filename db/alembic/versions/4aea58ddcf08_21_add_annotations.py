@@ -0,0 +1,39 @@
+"""21-add_annotations
+
+Revision ID: 4aea58ddcf08
+Revises: 2196486882f6
+Create Date: 2026-10-19 12:55:56.597401
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = '4aea58ddcf08'
+down_revision = '2196486882f6'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.execute('''
+        CREATE TABLE annotation (
+            id serial PRIMARY KEY,
+            plot_id int NOT NULL REFERENCES plot (id) ON DELETE CASCADE,
+            timestamp timestamp NOT NULL,
+            end_time timestamp,
+            text varchar(2048) NOT NULL,
+            category varchar(64) NOT NULL DEFAULT '',
+            image_url varchar(2048) NOT NULL DEFAULT '',
+            created_by varchar(255) REFERENCES login (id),
+            created_at timestamp NOT NULL DEFAULT now()
+        );
+        CREATE INDEX annotation_plot_id_idx ON annotation (plot_id, timestamp);
+    ''')
+
+
+def downgrade():
+    op.execute('''
+        DROP TABLE annotation;
+    ''')
@@ -0,0 +1,37 @@
+"""11-add_device_authorization
+
+Revision ID: 4d217012f040
+Revises: 47162dcd8db5
+Create Date: 2026-10-19 12:41:37.517325
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = '4d217012f040'
+down_revision = '47162dcd8db5'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.execute('''
+    CREATE TABLE device_authorization (
+        device_code_hash varchar(255) PRIMARY KEY,
+        user_code varchar(255) UNIQUE NOT NULL,
+        device_name varchar(255) NOT NULL,
+        login varchar(255) REFERENCES login (id) ON DELETE CASCADE,
+        status varchar(255) NOT NULL DEFAULT 'pending',
+        created_at timestamp NOT NULL DEFAULT now(),
+        expires_at timestamp NOT NULL,
+        last_polled_at timestamp
+    );
+    ''')
+
+
+def downgrade():
+    op.execute('''
+    DROP TABLE device_authorization
+    ''')
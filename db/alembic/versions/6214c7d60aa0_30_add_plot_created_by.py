@@ -0,0 +1,31 @@
+"""30-add_plot_created_by
+
+Revision ID: 6214c7d60aa0
+Revises: 78b53dab3b33
+Create Date: 2026-10-19 13:33:19.916003
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = '6214c7d60aa0'
+down_revision = '78b53dab3b33'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.execute('''
+        ALTER TABLE plot ADD COLUMN created_by varchar(255) REFERENCES login (id) ON DELETE SET NULL;
+        UPDATE plot SET created_by = login;
+        UPDATE plot SET login = NULL WHERE organization_id IS NOT NULL;
+    ''')
+
+
+def downgrade():
+    op.execute('''
+        UPDATE plot SET login = created_by WHERE organization_id IS NOT NULL;
+        ALTER TABLE plot DROP COLUMN created_by;
+    ''')
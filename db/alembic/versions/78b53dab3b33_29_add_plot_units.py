@@ -0,0 +1,30 @@
+"""29-add_plot_units
+
+Revision ID: 78b53dab3b33
+Revises: 47a7355f8d82
+Create Date: 2026-10-19 13:18:47.976091
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = '78b53dab3b33'
+down_revision = '47a7355f8d82'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.execute('''
+        ALTER TABLE plot ADD COLUMN gravity_unit varchar(8) NOT NULL DEFAULT 'sg';
+        ALTER TABLE plot ADD COLUMN temperature_unit varchar(1) NOT NULL DEFAULT 'C';
+    ''')
+
+
+def downgrade():
+    op.execute('''
+        ALTER TABLE plot DROP COLUMN temperature_unit;
+        ALTER TABLE plot DROP COLUMN gravity_unit;
+    ''')
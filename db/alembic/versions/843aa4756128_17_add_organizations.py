@@ -0,0 +1,53 @@
+"""17-add_organizations
+
+Revision ID: 843aa4756128
+Revises: cd3258bdd5df
+Create Date: 2026-10-19 12:47:18.101531
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = '843aa4756128'
+down_revision = 'cd3258bdd5df'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.execute('''
+    CREATE TABLE organization (
+        id serial PRIMARY KEY,
+        name varchar(255) NOT NULL,
+        created_at timestamp NOT NULL DEFAULT now()
+    );
+    ''')
+    op.execute('''
+    CREATE TABLE organization_member (
+        organization_id integer NOT NULL REFERENCES organization ON DELETE CASCADE,
+        login varchar(255) NOT NULL REFERENCES login (id) ON DELETE CASCADE,
+        role varchar(255) NOT NULL,
+        PRIMARY KEY (organization_id, login)
+    );
+    ''')
+    op.execute('''
+        ALTER TABLE plot ADD COLUMN organization_id integer REFERENCES organization ON DELETE CASCADE;
+        ALTER TABLE apikey ADD COLUMN organization_id integer REFERENCES organization ON DELETE CASCADE;
+        ALTER TABLE measurement ADD COLUMN organization_id integer REFERENCES organization ON DELETE SET NULL;
+    ''')
+
+
+def downgrade():
+    op.execute('''
+        ALTER TABLE measurement DROP COLUMN organization_id;
+        ALTER TABLE apikey DROP COLUMN organization_id;
+        ALTER TABLE plot DROP COLUMN organization_id;
+    ''')
+    op.execute('''
+    DROP TABLE organization_member
+    ''')
+    op.execute('''
+    DROP TABLE organization
+    ''')
@@ -0,0 +1,39 @@
+"""26-add_measurement_audit
+
+Revision ID: 8c738a913a64
+Revises: 324cb2d18cb1
+Create Date: 2026-10-19 13:03:15.323051
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = '8c738a913a64'
+down_revision = '324cb2d18cb1'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.execute('''
+        CREATE TABLE measurement_audit (
+            id serial PRIMARY KEY,
+            measurement_id int NOT NULL,
+            login varchar(255) NOT NULL REFERENCES login (id),
+            key varchar(255) NOT NULL,
+            timestamp timestamp with time zone NOT NULL,
+            action varchar(16) NOT NULL,
+            old_value double precision NOT NULL,
+            new_value double precision,
+            changed_at timestamp with time zone NOT NULL DEFAULT now()
+        );
+        CREATE INDEX measurement_audit_login_idx ON measurement_audit (login, changed_at);
+    ''')
+
+
+def downgrade():
+    op.execute('''
+        DROP TABLE measurement_audit;
+    ''')
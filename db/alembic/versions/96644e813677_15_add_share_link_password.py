@@ -0,0 +1,28 @@
+"""15-add_share_link_password
+
+Revision ID: 96644e813677
+Revises: fe6e1cdededf
+Create Date: 2026-10-19 12:44:53.201067
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = '96644e813677'
+down_revision = 'fe6e1cdededf'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.execute('''
+        ALTER TABLE sharelink ADD COLUMN password_hash varchar(255);
+    ''')
+
+
+def downgrade():
+    op.execute('''
+        ALTER TABLE sharelink DROP COLUMN password_hash;
+    ''')
@@ -0,0 +1,34 @@
+"""12-add_request_nonce
+
+Revision ID: b1498c28d295
+Revises: 4d217012f040
+Create Date: 2026-10-19 12:42:38.428481
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = 'b1498c28d295'
+down_revision = '4d217012f040'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.execute('''
+    CREATE TABLE request_nonce (
+        apikey_id integer NOT NULL REFERENCES apikey (id) ON DELETE CASCADE,
+        nonce varchar(255) NOT NULL,
+        created_at timestamp NOT NULL DEFAULT now(),
+        PRIMARY KEY (apikey_id, nonce)
+    );
+    CREATE INDEX request_nonce_created_at ON request_nonce (created_at);
+    ''')
+
+
+def downgrade():
+    op.execute('''
+    DROP TABLE request_nonce
+    ''')
@@ -0,0 +1,36 @@
+"""9-add_api_key_scopes
+
+Revision ID: ca6f4bc2b70b
+Revises: ce83ce266606
+Create Date: 2026-10-19 12:38:25.148151
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = 'ca6f4bc2b70b'
+down_revision = 'ce83ce266606'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.execute('''
+    CREATE TABLE apikey (
+        id serial PRIMARY KEY,
+        login varchar(255) NOT NULL REFERENCES login (id) ON DELETE CASCADE,
+        key varchar(255) UNIQUE NOT NULL,
+        name varchar(255),
+        write boolean NOT NULL DEFAULT true,
+        instrument_patterns varchar(255)[] NOT NULL DEFAULT '{}',
+        read_plots integer[] NOT NULL DEFAULT '{}'
+    );
+    ''')
+
+
+def downgrade():
+    op.execute('''
+    DROP TABLE apikey
+    ''')
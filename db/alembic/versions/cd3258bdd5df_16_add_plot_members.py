@@ -0,0 +1,47 @@
+"""16-add_plot_members
+
+Revision ID: cd3258bdd5df
+Revises: 96644e813677
+Create Date: 2026-10-19 12:45:41.039352
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = 'cd3258bdd5df'
+down_revision = '96644e813677'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.execute('''
+    CREATE TABLE plot_member (
+        plot_id integer NOT NULL REFERENCES plot ON DELETE CASCADE,
+        login varchar(255) NOT NULL REFERENCES login (id) ON DELETE CASCADE,
+        role varchar(255) NOT NULL,
+        PRIMARY KEY (plot_id, login)
+    );
+    ''')
+    op.execute('''
+    CREATE TABLE plot_invitation (
+        id serial PRIMARY KEY,
+        plot_id integer NOT NULL REFERENCES plot ON DELETE CASCADE,
+        email varchar(255) NOT NULL,
+        role varchar(255) NOT NULL,
+        invited_by varchar(255) NOT NULL REFERENCES login (id) ON DELETE CASCADE,
+        created_at timestamp NOT NULL DEFAULT now(),
+        UNIQUE (plot_id, email)
+    );
+    ''')
+
+
+def downgrade():
+    op.execute('''
+    DROP TABLE plot_invitation
+    ''')
+    op.execute('''
+    DROP TABLE plot_member
+    ''')
@@ -0,0 +1,45 @@
+"""22-add_batch_metadata
+
+Revision ID: cea3673da545
+Revises: 4aea58ddcf08
+Create Date: 2026-10-19 12:56:51.458308
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = 'cea3673da545'
+down_revision = '4aea58ddcf08'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.execute('''
+        ALTER TABLE plot ADD COLUMN style varchar(255) NOT NULL DEFAULT '';
+        ALTER TABLE plot ADD COLUMN recipe varchar(255) NOT NULL DEFAULT '';
+        ALTER TABLE plot ADD COLUMN batch_size double precision;
+        ALTER TABLE plot ADD COLUMN yeast varchar(255) NOT NULL DEFAULT '';
+        ALTER TABLE plot ADD COLUMN target_og double precision;
+        ALTER TABLE plot ADD COLUMN target_fg double precision;
+        ALTER TABLE plot ADD COLUMN target_temp_min double precision;
+        ALTER TABLE plot ADD COLUMN target_temp_max double precision;
+        ALTER TABLE plot ADD COLUMN tags varchar(64)[] NOT NULL DEFAULT '{}';
+        CREATE INDEX plot_tags_idx ON plot USING gin (tags);
+    ''')
+
+
+def downgrade():
+    op.execute('''
+        ALTER TABLE plot DROP COLUMN style;
+        ALTER TABLE plot DROP COLUMN recipe;
+        ALTER TABLE plot DROP COLUMN batch_size;
+        ALTER TABLE plot DROP COLUMN yeast;
+        ALTER TABLE plot DROP COLUMN target_og;
+        ALTER TABLE plot DROP COLUMN target_fg;
+        ALTER TABLE plot DROP COLUMN target_temp_min;
+        ALTER TABLE plot DROP COLUMN target_temp_max;
+        ALTER TABLE plot DROP COLUMN tags;
+    ''')
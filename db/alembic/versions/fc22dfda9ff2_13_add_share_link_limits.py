@@ -0,0 +1,32 @@
+"""13-add_share_link_limits
+
+Revision ID: fc22dfda9ff2
+Revises: b1498c28d295
+Create Date: 2026-10-19 12:43:16.299961
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = 'fc22dfda9ff2'
+down_revision = 'b1498c28d295'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.execute('''
+        ALTER TABLE sharelink ADD COLUMN expires_at timestamp;
+        ALTER TABLE sharelink ADD COLUMN window_start timestamp;
+        ALTER TABLE sharelink ADD COLUMN window_end timestamp;
+    ''')
+
+
+def downgrade():
+    op.execute('''
+        ALTER TABLE sharelink DROP COLUMN expires_at;
+        ALTER TABLE sharelink DROP COLUMN window_start;
+        ALTER TABLE sharelink DROP COLUMN window_end;
+    ''')
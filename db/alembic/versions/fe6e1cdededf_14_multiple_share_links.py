@@ -0,0 +1,42 @@
+"""14-multiple_share_links
+
+Revision ID: fe6e1cdededf
+Revises: fc22dfda9ff2
+Create Date: 2026-10-19 12:43:58.904531
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = 'fe6e1cdededf'
+down_revision = 'fc22dfda9ff2'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.execute('''
+        ALTER TABLE sharelink DROP CONSTRAINT sharelink_plot_id_key;
+        ALTER TABLE sharelink ADD COLUMN label varchar(255);
+        ALTER TABLE sharelink ADD COLUMN created_at timestamp NOT NULL DEFAULT now();
+        ALTER TABLE sharelink ADD COLUMN views integer NOT NULL DEFAULT 0;
+        ALTER TABLE sharelink ADD COLUMN data_requests integer NOT NULL DEFAULT 0;
+        ALTER TABLE sharelink ADD COLUMN last_accessed timestamp;
+        CREATE INDEX sharelink_plot_id ON sharelink (plot_id);
+    ''')
+
+
+def downgrade():
+    op.execute('''
+        DROP INDEX sharelink_plot_id;
+        DELETE FROM sharelink s USING sharelink o
+            WHERE s.plot_id = o.plot_id AND s.created_at > o.created_at;
+        ALTER TABLE sharelink DROP COLUMN label;
+        ALTER TABLE sharelink DROP COLUMN created_at;
+        ALTER TABLE sharelink DROP COLUMN views;
+        ALTER TABLE sharelink DROP COLUMN data_requests;
+        ALTER TABLE sharelink DROP COLUMN last_accessed;
+        ALTER TABLE sharelink ADD CONSTRAINT sharelink_plot_id_key UNIQUE (plot_id);
+    ''')
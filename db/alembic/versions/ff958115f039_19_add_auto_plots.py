@@ -0,0 +1,46 @@
+"""19-add_auto_plots
+
+Revision ID: ff958115f039
+Revises: 47b2a153c6b4
+Create Date: 2026-10-19 12:53:56.899109
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = 'ff958115f039'
+down_revision = '47b2a153c6b4'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.execute('''
+        CREATE TABLE auto_plot_rule (
+            login varchar(255) PRIMARY KEY REFERENCES login (id),
+            enabled boolean NOT NULL DEFAULT false,
+            name_template varchar(255) NOT NULL
+        );
+    ''')
+    op.execute('''
+        CREATE TABLE notification (
+            id serial PRIMARY KEY,
+            login varchar(255) NOT NULL REFERENCES login (id),
+            message varchar(1024) NOT NULL,
+            plot_id int REFERENCES plot (id) ON DELETE SET NULL,
+            created_at timestamp NOT NULL DEFAULT now(),
+            read boolean NOT NULL DEFAULT false
+        );
+        CREATE INDEX notification_login_idx ON notification (login, created_at);
+    ''')
+
+
+def downgrade():
+    op.execute('''
+        DROP TABLE notification;
+    ''')
+    op.execute('''
+        DROP TABLE auto_plot_rule;
+    ''')
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	deviceCodeLifetime  = 10 * time.Minute
+	devicePollInterval  = 5 * time.Second
+	userCodeAlphabet    = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength      = 8
+	maxDeviceNameLength = 255
+)
+
+type DeviceCodeRequest struct {
+	DeviceName string `json:"deviceName"`
+}
+
+type DeviceCodeResponse struct {
+	DeviceCode      string `json:"deviceCode"`
+	UserCode        string `json:"userCode"`
+	VerificationUri string `json:"verificationUri,omitempty"`
+	ExpiresIn       int    `json:"expiresIn"`
+	Interval        int    `json:"interval"`
+}
+
+type DeviceTokenRequest struct {
+	DeviceCode string `json:"deviceCode"`
+}
+
+type DeviceTokenResponse struct {
+	Key  string `json:"key"`
+	Name string `json:"name"`
+}
+
+// Errors follow the OAuth 2.0 device authorization grant (RFC 8628).
+type DeviceTokenError struct {
+	Error string `json:"error"`
+}
+
+// User codes are typed by hand, so they only use consonants that are hard
+// to mix up, formatted as XXXX-XXXX.
+func newUserCode() (string, error) {
+	code := make([]byte, userCodeLength)
+	max := big.NewInt(int64(len(userCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = userCodeAlphabet[n.Int64()]
+	}
+	return string(code[:userCodeLength/2]) + "-" + string(code[userCodeLength/2:]), nil
+}
+
+func normalizeUserCode(userCode string) string {
+	var code []rune
+	for _, c := range strings.ToUpper(userCode) {
+		if c >= 'A' && c <= 'Z' {
+			code = append(code, c)
+		}
+	}
+	if len(code) != userCodeLength {
+		return string(code)
+	}
+	return string(code[:userCodeLength/2]) + "-" + string(code[userCodeLength/2:])
+}
+
+func parseDeviceCodeRequest(r *http.Request) (DeviceCodeRequest, error) {
+	decoder := json.NewDecoder(r.Body)
+	var request DeviceCodeRequest
+	err := decoder.Decode(&request)
+	if err != nil {
+		return DeviceCodeRequest{}, err
+	}
+	defer r.Body.Close()
+
+	request.DeviceName = strings.TrimSpace(request.DeviceName)
+	if request.DeviceName == "" {
+		return DeviceCodeRequest{}, errors.New("Device name must be specified")
+	}
+	if len(request.DeviceName) > maxDeviceNameLength {
+		return DeviceCodeRequest{}, errors.New("Device name is too long")
+	}
+	return request, nil
+}
+
+func writeDeviceTokenError(w http.ResponseWriter, code string) {
+	jsonData, _ := json.Marshal(DeviceTokenError{Error: code})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(jsonData)
+}
+
+func (env *Env) requestDeviceCode(w http.ResponseWriter, r *http.Request) {
+	request, err := parseDeviceCodeRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	deviceCode, deviceCodeHash, err := newSecret()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Retry in the unlikely event that the user code is already in use
+	var userCode string
+	for attempt := 0; attempt < 3; attempt++ {
+		userCode, err = newUserCode()
+		if err != nil {
+			break
+		}
+		err = env.db.createDeviceAuthorization(deviceCodeHash, userCode, request.DeviceName, deviceCodeLifetime)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"device-name": request.DeviceName,
+		"user-code":   userCode,
+	}).Info("Device authorization requested")
+
+	jsonData, _ := json.Marshal(DeviceCodeResponse{
+		DeviceCode:      deviceCode,
+		UserCode:        userCode,
+		VerificationUri: os.Getenv("DEVICE_VERIFICATION_URI"),
+		ExpiresIn:       int(deviceCodeLifetime.Seconds()),
+		Interval:        int(devicePollInterval.Seconds()),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+func (env *Env) pollDeviceToken(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var request DeviceTokenRequest
+	err := decoder.Decode(&request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	authorization, apiKey, err := env.db.pollDeviceAuthorization(hashSecret(request.DeviceCode), devicePollInterval)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case authorization == nil:
+		writeDeviceTokenError(w, "invalid_grant")
+	case authorization.Expired:
+		writeDeviceTokenError(w, "expired_token")
+	case authorization.Status == "denied":
+		writeDeviceTokenError(w, "access_denied")
+	case apiKey != nil:
+		log.WithFields(log.Fields{
+			"device-name": authorization.DeviceName,
+			"id":          apiKey.Login,
+			"key-id":      apiKey.Id,
+		}).Info("Issued key to device")
+
+		jsonData, _ := json.Marshal(DeviceTokenResponse{Key: apiKey.Key, Name: apiKey.Name})
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonData)
+	case authorization.Status == "issued":
+		// The key is only handed out once
+		writeDeviceTokenError(w, "invalid_grant")
+	case authorization.TooFast:
+		writeDeviceTokenError(w, "slow_down")
+	default:
+		writeDeviceTokenError(w, "authorization_pending")
+	}
+}
+
+func (env *Env) getDeviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	userCode := normalizeUserCode(mux.Vars(r)["userCode"])
+	authorization, err := env.db.getPendingDeviceAuthorization(userCode)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if authorization == nil {
+		http.Error(w, "No pending device found for code", http.StatusNotFound)
+		return
+	}
+
+	jsonData, _ := json.Marshal(authorization)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+func (env *Env) decideDeviceAuthorization(w http.ResponseWriter, r *http.Request, approve bool) {
+	user, err := getUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	userCode := normalizeUserCode(mux.Vars(r)["userCode"])
+	updated, err := env.db.decideDeviceAuthorization(userCode, user, approve)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !updated {
+		http.Error(w, "No pending device found for code", http.StatusNotFound)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"id":        user,
+		"user-code": userCode,
+		"approved":  approve,
+	}).Info("Device authorization decided")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (env *Env) approveDevice(w http.ResponseWriter, r *http.Request) {
+	env.decideDeviceAuthorization(w, r, true)
+}
+
+func (env *Env) denyDevice(w http.ResponseWriter, r *http.Request) {
+	env.decideDeviceAuthorization(w, r, false)
+}
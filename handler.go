@@ -1,11 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	log "github.com/Sirupsen/logrus"
 	"github.com/auth0/go-jwt-middleware"
 	"github.com/dgrijalva/jwt-go"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	maxClockSkew      = 5 * time.Minute
+	maxSignedBodySize = 1 << 20
 )
 
 type KeyCheckHandler struct {
@@ -15,61 +29,187 @@ type KeyCheckHandler struct {
 type JwtCheckHandler struct {
 	db            *Database
 	jwtMiddleware *jwtmiddleware.JWTMiddleware
+	issuers       Issuers
+	localAuth     *LocalAuth
 }
 
 func (h *KeyCheckHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 
-	key := r.Header.Get("X-PYTILT-KEY")
-	if key == "" {
-		http.Error(w, "key not specified", http.StatusUnauthorized)
-		return
+	var apiKey *ApiKey
+	var err error
+	if r.Header.Get("X-PYTILT-SIGNATURE") != "" {
+		apiKey, err = h.checkSignature(r)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":    err,
+				"key-id": r.Header.Get("X-PYTILT-KEY-ID"),
+			}).Warn("Rejected signed request")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	} else {
+		key := r.Header.Get("X-PYTILT-KEY")
+		if key == "" {
+			http.Error(w, "key not specified", http.StatusUnauthorized)
+			return
+		}
+		apiKey, err = h.db.getApiKey(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
 	}
-	user, err := h.db.getUserForKey(key)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusForbidden)
+
+	// Read-only keys may only be used to fetch data
+	if r.Method != "GET" && r.Method != "HEAD" && !apiKey.Write {
+		http.Error(w, "key does not allow writing", http.StatusForbidden)
+		return
 	}
-	if err == nil && next != nil {
+
+	if next != nil {
 		ctx := r.Context()
-		ctx = context.WithValue(ctx, "user", user)
+		ctx = context.WithValue(ctx, "user", apiKey.Login)
+		ctx = context.WithValue(ctx, "apikey", apiKey)
 		r = r.WithContext(ctx)
 		next(w, r)
 	}
 }
 
+// Verify a request signed with an api key instead of sending the key itself.
+// The signature is the hex encoded HMAC-SHA256, using the key as secret, of
+//
+//	METHOD\nPATH\nTIMESTAMP\nNONCE\nBODY
+//
+// where TIMESTAMP is unix seconds and NONCE is never reused with the key.
+// The body is restored on the request after it has been read.
+func (h *KeyCheckHandler) checkSignature(r *http.Request) (*ApiKey, error) {
+	keyId, err := strconv.Atoi(r.Header.Get("X-PYTILT-KEY-ID"))
+	if err != nil {
+		return nil, errors.New("invalid key id")
+	}
+
+	timestamp := r.Header.Get("X-PYTILT-TIMESTAMP")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid timestamp")
+	}
+	skew := time.Since(time.Unix(seconds, 0))
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		return nil, errors.New("timestamp outside allowed clock skew")
+	}
+
+	nonce := r.Header.Get("X-PYTILT-NONCE")
+	if nonce == "" || len(nonce) > 255 {
+		return nil, errors.New("invalid nonce")
+	}
+
+	signature, err := hex.DecodeString(r.Header.Get("X-PYTILT-SIGNATURE"))
+	if err != nil {
+		return nil, errors.New("invalid signature")
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSignedBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	r.Body.Close()
+	if len(body) > maxSignedBodySize {
+		return nil, errors.New("request body too large")
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	apiKey, err := h.db.getApiKeyById(keyId)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, []byte(apiKey.Key))
+	mac.Write([]byte(r.Method + "\n" + r.URL.Path + "\n" + r.URL.RawQuery + "\n" + timestamp + "\n" + nonce + "\n"))
+	mac.Write(body)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("signature mismatch")
+	}
+
+	// Only record the nonce once the signature is known to be valid, so
+	// that others cannot use up nonces
+	fresh, err := h.db.useNonce(apiKey.Id, nonce, 2*maxClockSkew)
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		return nil, errors.New("nonce already used")
+	}
+	return apiKey, nil
+}
+
+// Some issuers send email_verified as a string.
+func emailVerifiedClaim(claims jwt.MapClaims) bool {
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		return verified
+	case string:
+		return verified == "true"
+	}
+	return false
+}
+
 func (h *JwtCheckHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 	err := h.jwtMiddleware.CheckJWT(w, r)
 	if err == nil && next != nil {
 		claims := r.Context().Value("user").(*jwt.Token).Claims.(jwt.MapClaims)
-		if claims["iss"] == "https://securetoken.google.com/pitilt-7a37c" && claims["aud"] == "pitilt-7a37c" {
-			userId := claims["user_id"].(string)
-			exists, err := h.db.userExists(userId)
+		userId, err := h.issuers.userFromClaims(claims)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		if h.localAuth != nil {
+			active, err := h.localAuth.checkSession(claims)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !active {
+				http.Error(w, "session revoked or expired", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		email, _ := claims["email"].(string)
+		emailVerified := email != "" && emailVerifiedClaim(claims)
+		name, _ := claims["name"].(string)
+		exists, err := h.db.userExists(userId)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":    err,
+				"userId": userId,
+				"email":  email,
+			}).Error("Unable to check if user exists")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			err = h.db.createUser(userId, email, emailVerified, name)
 			if err != nil {
 				log.WithFields(log.Fields{
 					"err":    err,
 					"userId": userId,
-					"email":  claims["email"].(string),
-				}).Error("Unable to check if user exists")
+					"email":  email,
+				}).Error("Unable to create user")
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			if !exists {
-				err = h.db.createUser(userId, claims["email"].(string), claims["name"].(string))
-				if err != nil {
-					log.WithFields(log.Fields{
-						"err":    err,
-						"userId": userId,
-						"email":  claims["email"].(string),
-					}).Error("Unable to create user")
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
+		}
+		if exists && emailVerified {
+			err = h.db.setVerifiedEmail(userId, email)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
-			ctx := r.Context()
-			ctx = context.WithValue(ctx, "user", userId)
-			r = r.WithContext(ctx)
-			next(w, r)
-		} else {
-			http.Error(w, "key not valid", http.StatusUnauthorized)
 		}
+		ctx := r.Context()
+		ctx = context.WithValue(ctx, "user", userId)
+		r = r.WithContext(ctx)
+		next(w, r)
 	}
 }
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func getInstrumentId(r *http.Request) (int, error) {
+	vars := mux.Vars(r)
+	instrumentId, err := strconv.Atoi(vars["instrumentId"])
+	if err != nil {
+		return instrumentId, errors.New("Invalid instrument id: " + vars["instrumentId"])
+	}
+
+	return instrumentId, err
+}
+
+// Instruments are shown as temperature or gravity series
+var instrumentTypes = map[string]bool{
+	"temperature": true,
+	"gravity":     true,
+}
+
+// Validate an instrument, adding any problems to the report under field.
+// Instruments without a name are named after their key.
+func validateInstrument(instrument Instrument, field string, report *ValidationReport) Instrument {
+	instrument.Key = strings.TrimSpace(instrument.Key)
+	instrument.Name = strings.TrimSpace(instrument.Name)
+	instrument.Type = strings.TrimSpace(instrument.Type)
+
+	if instrument.Key == "" {
+		report.add(field+"key", "must be specified")
+	} else if len(instrument.Key) > 255 {
+		report.add(field+"key", "must be at most 255 characters")
+	}
+	if instrument.Name == "" {
+		instrument.Name = instrument.Key
+	} else if len(instrument.Name) > 255 {
+		report.add(field+"name", "must be at most 255 characters")
+	}
+	if !instrumentTypes[instrument.Type] {
+		report.add(field+"type", "must be temperature or gravity")
+	}
+	return instrument
+}
+
+// Guess the type of an instrument from a value. Gravity is sent either as
+// specific gravity (1.050) or in points (1050), which is outside the range
+// of fermentation temperatures in both Celsius and Fahrenheit.
+func guessInstrumentType(value float64) string {
+	if (value >= 0.98 && value < 1.2) || (value >= 980 && value < 1200) {
+		return "gravity"
+	}
+	return "temperature"
+}
+
+func parseInstrument(r *http.Request) (Instrument, error) {
+	decoder := json.NewDecoder(r.Body)
+	var instrument Instrument
+	err := decoder.Decode(&instrument)
+	if err != nil {
+		return Instrument{}, err
+	}
+	defer r.Body.Close()
+
+	report := ValidationReport{Message: "Invalid instrument"}
+	instrument = validateInstrument(instrument, "", &report)
+	if len(report.Problems) > 0 {
+		return Instrument{}, &report
+	}
+	return instrument, nil
+}
+
+// Instrument keys must be unique within a plot, so that every measurement
+// belongs to a single series.
+func (env *Env) checkInstrumentKey(w http.ResponseWriter, plotId int, instrument Instrument) bool {
+	inUse, err := env.db.instrumentKeyInUse(plotId, instrument.Key, instrument.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	if inUse {
+		report := ValidationReport{Message: "Invalid instrument"}
+		report.add("key", "is already used in plot")
+		writeRequestError(w, &report, http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+func (env *Env) getPlotInstruments(w http.ResponseWriter, r *http.Request) {
+	_, plotId, ok := env.checkPlotAccess(w, r, Viewer)
+	if !ok {
+		return
+	}
+
+	instruments, err := env.db.getInstruments(plotId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, _ := json.Marshal(instruments)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+func (env *Env) addInstrument(w http.ResponseWriter, r *http.Request) {
+	user, plotId, ok := env.checkPlotAccess(w, r, Editor)
+	if !ok {
+		return
+	}
+
+	instrument, err := parseInstrument(r)
+	if err != nil {
+		writeRequestError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if !env.checkInstrumentKey(w, plotId, instrument) {
+		return
+	}
+
+	instrument, err = env.db.addInstrument(plotId, instrument)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"id":      user,
+		"plot-id": plotId,
+		"key":     instrument.Key,
+	}).Info("Added instrument to plot")
+
+	jsonData, _ := json.Marshal(instrument)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonData)
+}
+
+func (env *Env) updateInstrument(w http.ResponseWriter, r *http.Request) {
+	_, plotId, ok := env.checkPlotAccess(w, r, Editor)
+	if !ok {
+		return
+	}
+
+	instrumentId, err := getInstrumentId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	instrument, err := parseInstrument(r)
+	if err != nil {
+		writeRequestError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// Must use the id from the url, not the json
+	instrument.Id = instrumentId
+	if !env.checkInstrumentKey(w, plotId, instrument) {
+		return
+	}
+
+	updated, err := env.db.updateInstrument(plotId, instrument)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !updated {
+		http.Error(w, "Instrument not found", http.StatusNotFound)
+		return
+	}
+
+	jsonData, _ := json.Marshal(instrument)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+func (env *Env) removeInstrument(w http.ResponseWriter, r *http.Request) {
+	_, plotId, ok := env.checkPlotAccess(w, r, Editor)
+	if !ok {
+		return
+	}
+
+	instrumentId, err := getInstrumentId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	removed, err := env.db.removeInstrument(plotId, instrumentId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !removed {
+		http.Error(w, "Instrument not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (env *Env) getDiscoveredInstruments(w http.ResponseWriter, r *http.Request) {
+	user, err := getUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	instruments, err := env.db.getDiscoveredInstruments(user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for i := range instruments {
+		instruments[i].Type = guessInstrumentType(instruments[i].LastValue)
+	}
+
+	jsonData, _ := json.Marshal(instruments)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pquerna/cachecontrol"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+const (
+	firebaseProject = "pitilt-7a37c"
+	firebaseIssuer  = "https://securetoken.google.com/" + firebaseProject
+)
+
+// Issuer describes a trusted token issuer and where to find the keys used
+// to verify its tokens. Exactly one of JwksUrl, X509Url and KeyFile is set.
+// User ids are prefixed with userPrefix, so that the same subject from two
+// issuers are different users.
+type Issuer struct {
+	Issuer    string `json:"issuer"`
+	Audience  string `json:"audience"`
+	JwksUrl   string `json:"jwksUrl,omitempty"`
+	X509Url   string `json:"x509Url,omitempty"`
+	KeyFile   string `json:"keyFile,omitempty"`
+	UserClaim string `json:"userClaim,omitempty"`
+
+	keySource  KeySource
+	userPrefix string
+}
+
+type Issuers []*Issuer
+
+type KeySource interface {
+	getKey(kid string) (*rsa.PublicKey, error)
+}
+
+type jwk struct {
+	Kid string   `json:"kid"`
+	Kty string   `json:"kty"`
+	N   string   `json:"n"`
+	E   string   `json:"e"`
+	X5c []string `json:"x5c"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// Keys fetched from a remote url, either as x509 metadata (a map from key id
+// to PEM certificate, as served by Google) or as a JWKS document.
+type remoteKeySource struct {
+	url  string
+	jwks bool
+}
+
+// Keys read once from a local PEM or JWKS file.
+type fileKeySource struct {
+	keys map[string]*rsa.PublicKey
+}
+
+func defaultIssuers() Issuers {
+	return Issuers{&Issuer{
+		Issuer:    firebaseIssuer,
+		Audience:  firebaseProject,
+		X509Url:   "https://www.googleapis.com/robot/v1/metadata/x509/securetoken@system.gserviceaccount.com",
+		UserClaim: "user_id",
+	}}
+}
+
+// Read the trusted issuers from the JSON file given by path, or use the
+// Firebase project if no path is given.
+func loadIssuers(path string) (Issuers, error) {
+	issuers := defaultIssuers()
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		issuers = Issuers{}
+		err = json.Unmarshal(data, &issuers)
+		if err != nil {
+			return nil, errors.New("Invalid issuer config " + path + ": " + err.Error())
+		}
+	}
+
+	if len(issuers) == 0 {
+		return nil, errors.New("No trusted issuers configured")
+	}
+
+	for _, issuer := range issuers {
+		err := issuer.init()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return issuers, nil
+}
+
+func (issuer *Issuer) init() error {
+	if issuer.Issuer == "" || issuer.Audience == "" {
+		return errors.New("Issuer and audience must be set for every issuer")
+	}
+	if issuer.UserClaim == "" {
+		issuer.UserClaim = "sub"
+	}
+	// Users of the Firebase project keep the ids they had before other
+	// issuers could be trusted
+	if issuer.Issuer != firebaseIssuer {
+		issuer.userPrefix = issuer.Issuer + "|"
+	}
+
+	switch {
+	case issuer.JwksUrl != "" && issuer.X509Url == "" && issuer.KeyFile == "":
+		issuer.keySource = &remoteKeySource{url: issuer.JwksUrl, jwks: true}
+	case issuer.X509Url != "" && issuer.JwksUrl == "" && issuer.KeyFile == "":
+		issuer.keySource = &remoteKeySource{url: issuer.X509Url}
+	case issuer.KeyFile != "" && issuer.JwksUrl == "" && issuer.X509Url == "":
+		source, err := newFileKeySource(issuer.KeyFile)
+		if err != nil {
+			return err
+		}
+		issuer.keySource = source
+	default:
+		return errors.New("Exactly one key source must be set for issuer: " + issuer.Issuer)
+	}
+	return nil
+}
+
+func (issuers Issuers) find(iss interface{}) *Issuer {
+	for _, issuer := range issuers {
+		if issuer.Issuer == iss {
+			return issuer
+		}
+	}
+	return nil
+}
+
+// The audience claim may be a single string or a list of strings.
+func (issuer *Issuer) acceptsAudience(aud interface{}) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == issuer.Audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == issuer.Audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Used by the jwt middleware to look up the key for a token. The claims are
+// not verified yet, so the issuer is only used to choose the key source.
+func (issuers Issuers) getValidationKey(token *jwt.Token) (interface{}, error) {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, errors.New("Unexpected claims in token")
+	}
+
+	issuer := issuers.find(claims["iss"])
+	if issuer == nil {
+		return nil, fmt.Errorf("Untrusted issuer: %v", claims["iss"])
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	return issuer.keySource.getKey(kid)
+}
+
+// Check that the verified claims were issued to us by a trusted issuer and
+// return the user id.
+func (issuers Issuers) userFromClaims(claims jwt.MapClaims) (string, error) {
+	issuer := issuers.find(claims["iss"])
+	if issuer == nil || !issuer.acceptsAudience(claims["aud"]) {
+		return "", errors.New("key not valid")
+	}
+
+	userId, ok := claims[issuer.UserClaim].(string)
+	if !ok || userId == "" {
+		return "", errors.New("key not valid")
+	}
+	return issuer.userPrefix + userId, nil
+}
+
+func (source *remoteKeySource) getKey(kid string) (*rsa.PublicKey, error) {
+	cacheKey := source.url + "#" + kid
+	if key, found := myCache.Get(cacheKey); found {
+		log.WithFields(log.Fields{"id": kid}).Info("Public key found in cache")
+		return key.(*rsa.PublicKey), nil
+	}
+	log.WithFields(log.Fields{"id": kid}).Info("No public key found in cache")
+
+	req, _ := http.NewRequest("GET", source.url, nil)
+	res, err := myClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("Unable to fetch public keys from " + source.url + ": " + res.Status)
+	}
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys map[string]*rsa.PublicKey
+	if source.jwks {
+		keys, err = parseJwks(data)
+	} else {
+		keys, err = parseX509Metadata(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Try to cache the values for next requests
+	reasons, expires, _ := cachecontrol.CachableResponse(req, res, cachecontrol.Options{})
+	if len(reasons) == 0 {
+		timeUntilExpiration := time.Until(expires)
+		log.WithFields(log.Fields{"timeUntilExpiry": timeUntilExpiration}).Info("Caching public keys")
+
+		// Save all the identities
+		for id, key := range keys {
+			myCache.Set(source.url+"#"+id, key, timeUntilExpiration)
+		}
+	} else {
+		log.Println("Unable to cache public key:", reasons)
+	}
+
+	key, found := keys[kid]
+	if !found {
+		return nil, errors.New("Unknown key id: " + kid)
+	}
+	return key, nil
+}
+
+func newFileKeySource(path string) (*fileKeySource, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := parseJwks(data)
+	if err != nil {
+		// Not a JWKS document: try a single PEM encoded key or certificate,
+		// which is used regardless of the key id in the token.
+		key, pemErr := parsePublicKeyPem(data)
+		if pemErr != nil {
+			return nil, errors.New("Unable to read keys from " + path + ": not JWKS or PEM")
+		}
+		keys = map[string]*rsa.PublicKey{"": key}
+	}
+	return &fileKeySource{keys: keys}, nil
+}
+
+func (source *fileKeySource) getKey(kid string) (*rsa.PublicKey, error) {
+	if key, found := source.keys[kid]; found {
+		return key, nil
+	}
+	if key, found := source.keys[""]; found && len(source.keys) == 1 {
+		return key, nil
+	}
+	return nil, errors.New("Unknown key id: " + kid)
+}
+
+// The x509 metadata format maps key ids to PEM encoded certificates.
+func parseX509Metadata(data []byte) (map[string]*rsa.PublicKey, error) {
+	pems := make(map[string]string)
+	err := json.Unmarshal(data, &pems)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for kid, pemData := range pems {
+		key, err := parsePublicKeyPem([]byte(pemData))
+		if err != nil {
+			return nil, err
+		}
+		keys[kid] = key
+	}
+	return keys, nil
+}
+
+func parseJwks(data []byte) (map[string]*rsa.PublicKey, error) {
+	var set jwks
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, err
+	}
+	if set.Keys == nil {
+		return nil, errors.New("No keys in JWKS")
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, err
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (*rsa.PublicKey, error) {
+	if k.N != "" && k.E != "" {
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, errors.New("Invalid modulus for key " + k.Kid)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, errors.New("Invalid exponent for key " + k.Kid)
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	}
+
+	// Fall back to the certificate chain
+	if len(k.X5c) > 0 {
+		der, err := base64.StdEncoding.DecodeString(k.X5c[0])
+		if err != nil {
+			return nil, errors.New("Invalid certificate for key " + k.Kid)
+		}
+		return parsePublicKeyDer(der)
+	}
+	return nil, errors.New("No key material for key " + k.Kid)
+}
+
+func parsePublicKeyPem(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("Invalid PEM data")
+	}
+	return parsePublicKeyDer(block.Bytes)
+}
+
+// Accepts a certificate or a PKIX/PKCS1 encoded public key.
+func parsePublicKeyDer(der []byte) (*rsa.PublicKey, error) {
+	var publicKey interface{}
+	if cert, err := x509.ParseCertificate(der); err == nil {
+		publicKey = cert.PublicKey
+	} else if key, err := x509.ParsePKIXPublicKey(der); err == nil {
+		publicKey = key
+	} else if key, err := x509.ParsePKCS1PublicKey(der); err == nil {
+		publicKey = key
+	} else {
+		return nil, errors.New("Unable to parse public key")
+	}
+
+	rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Public key is not an RSA key")
+	}
+	return rsaPublicKey, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/dgrijalva/jwt-go"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, name)
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testPem(t *testing.T) []byte {
+	der, err := x509.MarshalPKIXPublicKey(&testKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func testJwks(t *testing.T, kid string) []byte {
+	data, err := json.Marshal(jwks{Keys: []jwk{{
+		Kid: kid,
+		Kty: "RSA",
+		N:   base64.RawURLEncoding.EncodeToString(testKey.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(testKey.E)).Bytes()),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func signTestToken(t *testing.T, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestGetValidationKey(t *testing.T) {
+	issuers := Issuers{&Issuer{
+		Issuer:   "https://issuer.example",
+		Audience: "pitilt",
+		KeyFile:  writeTestFile(t, "jwks.json", testJwks(t, "key-1")),
+	}}
+	if err := issuers[0].init(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		iss   string
+		kid   string
+		valid bool
+	}{
+		{"trusted issuer", "https://issuer.example", "key-1", true},
+		{"untrusted issuer", "https://other.example", "key-1", false},
+		{"unknown key id", "https://issuer.example", "key-2", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signed := signTestToken(t, test.kid, jwt.MapClaims{
+				"iss": test.iss,
+				"aud": "pitilt",
+				"sub": "user-1",
+				"exp": time.Now().Add(time.Hour).Unix(),
+			})
+
+			token, err := jwt.Parse(signed, issuers.getValidationKey)
+			if test.valid && (err != nil || !token.Valid) {
+				t.Errorf("expected a valid token, got %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Error("expected the token to be rejected")
+			}
+		})
+	}
+}
+
+func TestUserFromClaims(t *testing.T) {
+	keyFile := writeTestFile(t, "public.pem", testPem(t))
+	issuers := Issuers{
+		&Issuer{Issuer: "https://issuer.example", Audience: "pitilt", KeyFile: keyFile},
+		&Issuer{Issuer: "https://second.example", Audience: "pitilt", KeyFile: keyFile},
+		&Issuer{Issuer: firebaseIssuer, Audience: firebaseProject, KeyFile: keyFile, UserClaim: "user_id"},
+	}
+	for _, issuer := range issuers {
+		if err := issuer.init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	local := &LocalAuth{issuer: "pitilt-local", audience: "pitilt-local", privateKey: testKey}
+	issuers = append(issuers, local.trustedIssuer())
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		user   string
+	}{
+		{"audience", jwt.MapClaims{"iss": "https://issuer.example", "aud": "pitilt", "sub": "user-1"}, "https://issuer.example|user-1"},
+		{"audience list", jwt.MapClaims{"iss": "https://issuer.example", "aud": []interface{}{"other", "pitilt"}, "sub": "user-1"}, "https://issuer.example|user-1"},
+		{"same subject from another issuer", jwt.MapClaims{"iss": "https://second.example", "aud": "pitilt", "sub": "user-1"}, "https://second.example|user-1"},
+		{"firebase user claim", jwt.MapClaims{"iss": firebaseIssuer, "aud": firebaseProject, "user_id": "user-2", "sub": "other"}, "user-2"},
+		{"local user", jwt.MapClaims{"iss": "pitilt-local", "aud": "pitilt-local", "sub": "user-3"}, "user-3"},
+		{"wrong audience", jwt.MapClaims{"iss": "https://issuer.example", "aud": firebaseProject, "sub": "user-1"}, ""},
+		{"missing audience", jwt.MapClaims{"iss": "https://issuer.example", "sub": "user-1"}, ""},
+		{"missing user claim", jwt.MapClaims{"iss": firebaseIssuer, "aud": firebaseProject, "sub": "user-1"}, ""},
+		{"empty user claim", jwt.MapClaims{"iss": "https://issuer.example", "aud": "pitilt", "sub": ""}, ""},
+		{"unknown issuer", jwt.MapClaims{"iss": "https://other.example", "aud": "pitilt", "sub": "user-1"}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user, err := issuers.userFromClaims(test.claims)
+			if test.user == "" && err == nil {
+				t.Errorf("expected an error, got user %q", user)
+			}
+			if test.user != "" && (err != nil || user != test.user) {
+				t.Errorf("expected user %q, got %q (%v)", test.user, user, err)
+			}
+		})
+	}
+}
+
+func TestFileKeySource(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  []byte
+		kid   string
+		found bool
+	}{
+		{"pem with any key id", testPem(t), "whatever", true},
+		{"pem without key id", testPem(t), "", true},
+		{"jwks with key id", testJwks(t, "key-1"), "key-1", true},
+		{"jwks with unknown key id", testJwks(t, "key-1"), "key-2", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source, err := newFileKeySource(writeTestFile(t, "keys", test.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			key, err := source.getKey(test.kid)
+			if test.found && (err != nil || key.N.Cmp(testKey.N) != 0 || key.E != testKey.E) {
+				t.Errorf("expected the test key, got %v", err)
+			}
+			if !test.found && err == nil {
+				t.Error("expected an unknown key id")
+			}
+		})
+	}
+
+	_, err := newFileKeySource(writeTestFile(t, "keys", []byte("not a key")))
+	if err == nil {
+		t.Error("expected an error for a file that is neither PEM nor JWKS")
+	}
+}
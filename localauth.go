@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pborman/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	accessTokenLifetime  = 15 * time.Minute
+	refreshTokenLifetime = 30 * 24 * time.Hour
+	minPasswordLength    = 8
+)
+
+// LocalAuth lets users register and log in with a username and password
+// instead of Firebase. It issues its own access tokens, which are verified
+// by JwtCheckHandler like tokens from any other trusted issuer.
+type LocalAuth struct {
+	db         *Database
+	privateKey *rsa.PrivateKey
+	issuer     string
+	audience   string
+	// Compared against for unknown usernames, so that a failed login takes
+	// as long whether or not the username exists.
+	dummyHash []byte
+}
+
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email,omitempty"`
+	Name     string `json:"name,omitempty"`
+}
+
+type TokenResponse struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    int    `json:"expiresIn"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+func newLocalAuth(db *Database, keyFile string, issuer string) (*LocalAuth, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+	if err != nil {
+		return nil, errors.New("Unable to read private key from " + keyFile + ": " + err.Error())
+	}
+
+	if issuer == "" {
+		issuer = "pitilt-local"
+	}
+
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte(uuid.New()), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalAuth{db: db, privateKey: privateKey, issuer: issuer, audience: issuer, dummyHash: dummyHash}, nil
+}
+
+// The issuer to add to the trusted issuers, verifying tokens with our own key.
+// Its tokens carry the ids of our own users, so they are not prefixed.
+func (auth *LocalAuth) trustedIssuer() *Issuer {
+	return &Issuer{
+		Issuer:    auth.issuer,
+		Audience:  auth.audience,
+		UserClaim: "sub",
+		keySource: &fileKeySource{keys: map[string]*rsa.PublicKey{"": &auth.privateKey.PublicKey}},
+	}
+}
+
+// Access tokens carry the session id, so that logging out revokes them
+// before they expire.
+func (auth *LocalAuth) checkSession(claims jwt.MapClaims) (bool, error) {
+	if claims["iss"] != auth.issuer {
+		return true, nil
+	}
+
+	sessionId, ok := claims["sid"].(string)
+	if !ok {
+		return false, nil
+	}
+	return auth.db.sessionIsActive(sessionId)
+}
+
+func (auth *LocalAuth) issueAccessToken(user string, sessionId string) (string, error) {
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss": auth.issuer,
+		"aud": auth.audience,
+		"sub": user,
+		"sid": sessionId,
+		"iat": now.Unix(),
+		"exp": now.Add(accessTokenLifetime).Unix(),
+	})
+	return token.SignedString(auth.privateKey)
+}
+
+// Returns a random secret and the hash of it to store. Refresh tokens are
+// "<session id>.<secret>".
+func newSecret() (string, string, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	return encoded, hashSecret(encoded), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func splitRefreshToken(refreshToken string) (string, string, error) {
+	parts := strings.SplitN(refreshToken, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", ErrInvalidSession
+	}
+	return parts[0], parts[1], nil
+}
+
+func (auth *LocalAuth) startSession(user string) (TokenResponse, error) {
+	secret, hash, err := newSecret()
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	sessionId := uuid.New()
+	err = auth.db.createSession(sessionId, user, hash, refreshTokenLifetime)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	return auth.tokenResponse(user, sessionId, secret)
+}
+
+func (auth *LocalAuth) tokenResponse(user string, sessionId string, secret string) (TokenResponse, error) {
+	accessToken, err := auth.issueAccessToken(user, sessionId)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	return TokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: sessionId + "." + secret,
+		ExpiresIn:    int(accessTokenLifetime.Seconds()),
+	}, nil
+}
+
+func parseCredentials(r *http.Request) (Credentials, error) {
+	decoder := json.NewDecoder(r.Body)
+	var credentials Credentials
+	err := decoder.Decode(&credentials)
+	if err != nil {
+		return Credentials{}, err
+	}
+	defer r.Body.Close()
+
+	credentials.Username = strings.TrimSpace(credentials.Username)
+	if credentials.Username == "" {
+		return Credentials{}, errors.New("Username must be specified")
+	}
+	return credentials, nil
+}
+
+func parseRefreshRequest(r *http.Request) (string, string, error) {
+	decoder := json.NewDecoder(r.Body)
+	var request RefreshRequest
+	err := decoder.Decode(&request)
+	if err != nil {
+		return "", "", err
+	}
+	defer r.Body.Close()
+
+	return splitRefreshToken(request.RefreshToken)
+}
+
+func writeTokenResponse(w http.ResponseWriter, tokens TokenResponse, status int) {
+	jsonData, _ := json.Marshal(tokens)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(jsonData)
+}
+
+func (auth *LocalAuth) register(w http.ResponseWriter, r *http.Request) {
+	credentials, err := parseCredentials(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(credentials.Password) < minPasswordLength {
+		http.Error(w, "Password must be at least 8 characters", http.StatusBadRequest)
+		return
+	}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(credentials.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	name := credentials.Name
+	if name == "" {
+		name = credentials.Username
+	}
+	user, err := auth.db.createLocalUser(credentials.Username, string(passwordHash), credentials.Email, name)
+	if err == ErrUsernameTaken {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(log.Fields{"userId": user, "username": credentials.Username}).Info("Registered local user")
+
+	tokens, err := auth.startSession(user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeTokenResponse(w, tokens, http.StatusCreated)
+}
+
+func (auth *LocalAuth) login(w http.ResponseWriter, r *http.Request) {
+	credentials, err := parseCredentials(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, passwordHash, err := auth.db.getLocalCredential(credentials.Username)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	known := err != sql.ErrNoRows
+	if !known {
+		passwordHash = string(auth.dummyHash)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(credentials.Password)) != nil || !known {
+		log.WithFields(log.Fields{"username": credentials.Username}).Warn("Failed login")
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	tokens, err := auth.startSession(user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeTokenResponse(w, tokens, http.StatusOK)
+}
+
+func (auth *LocalAuth) refresh(w http.ResponseWriter, r *http.Request) {
+	sessionId, oldSecret, err := parseRefreshRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	secret, hash, err := newSecret()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user, err := auth.db.rotateSession(sessionId, hashSecret(oldSecret), hash, refreshTokenLifetime)
+	if err == ErrInvalidSession {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tokens, err := auth.tokenResponse(user, sessionId, secret)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeTokenResponse(w, tokens, http.StatusOK)
+}
+
+func (auth *LocalAuth) logout(w http.ResponseWriter, r *http.Request) {
+	sessionId, secret, err := parseRefreshRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = auth.db.revokeSession(sessionId, hashSecret(secret))
+	if err == ErrInvalidSession {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,11 +1,8 @@
 package main
 
 import (
-	"crypto/rsa"
-	"crypto/x509"
 	"database/sql"
 	"encoding/json"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
@@ -13,68 +10,24 @@ import (
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/meatballhat/negroni-logrus"
 	"github.com/patrickmn/go-cache"
-	"github.com/pquerna/cachecontrol"
 	"github.com/rs/cors"
 	"github.com/urfave/negroni"
+	"io"
 	"net/http"
 	"os"
+	"path"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
 var myClient = &http.Client{Timeout: 10 * time.Second}
 var myCache = cache.New(5*time.Hour, 10*time.Minute)
 
-func getKey(kid string) (*rsa.PublicKey, error) {
-	pemData, found := myCache.Get(kid)
-	if found {
-		log.WithFields(log.Fields{"id": kid}).Info("Public key found in cache")
-	} else {
-		log.WithFields(log.Fields{"id": kid}).Info("No public key found in cache")
-
-		// Get the new public keys (pem data) from google
-		req, _ := http.NewRequest("GET", "https://www.googleapis.com/robot/v1/metadata/x509/securetoken@system.gserviceaccount.com", nil)
-		res, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return nil, err
-		}
-
-		// The response contains multiple PEMs
-		decoder := json.NewDecoder(res.Body)
-		personMap := make(map[string]interface{})
-		err = decoder.Decode(&personMap)
-		if err != nil {
-			return nil, err
-		}
-
-		// Try to cache the values for next requests
-		reasons, expires, _ := cachecontrol.CachableResponse(req, res, cachecontrol.Options{})
-		if len(reasons) == 0 {
-			timeUntilExpiration := time.Until(expires)
-			log.WithFields(log.Fields{"timeUntilExpiry": timeUntilExpiration}).Info("Caching public keys")
-
-			// Save all the identities
-			for id, publicKeyData := range personMap {
-				myCache.Set(id, publicKeyData, timeUntilExpiration)
-			}
-		} else {
-			log.Println("Unable to cache public key:", reasons)
-		}
-
-		pemData = personMap[kid]
-	}
-
-	block, _ := pem.Decode([]byte(pemData.(string)))
-	var cert *x509.Certificate
-	cert, _ = x509.ParseCertificate(block.Bytes)
-	rsaPublicKey := cert.PublicKey.(*rsa.PublicKey)
-	return rsaPublicKey, nil
-}
-
 func parseMeasurements(r *http.Request) ([]Measurement, error) {
 	decoder := json.NewDecoder(r.Body)
 	var measurements []Measurement
@@ -119,6 +72,15 @@ func getUser(r *http.Request) (string, error) {
 	return user, nil
 }
 
+func getApiKey(r *http.Request) (*ApiKey, error) {
+	apiKey, ok := r.Context().Value("apikey").(*ApiKey)
+	if !ok {
+		return nil, errors.New("api key not found in context")
+	}
+
+	return apiKey, nil
+}
+
 func getPlotId(r *http.Request) (int, error) {
 	vars := mux.Vars(r)
 	plotId, err := strconv.Atoi(vars["plotId"])
@@ -140,8 +102,45 @@ func (env *Env) getShareLinkFromUuid(r *http.Request) (*ShareLink, error) {
 	return shareLink, err
 }
 
-func checkIfUserOwnsPlot(user string, plotId int, db *Database) (bool, error) {
-	return db.checkIfUserOwnsPlot(user, plotId)
+func checkPlotPermission(user string, plotId int, required Role, db *Database) (bool, error) {
+	role, err := db.getPlotRole(user, plotId)
+	if err != nil {
+		return false, err
+	}
+	return role >= required, nil
+}
+
+// Get the user and plot id from the request and verify that the user has at
+// least the required role on the plot, writing an error response if not.
+func (env *Env) checkPlotAccess(w http.ResponseWriter, r *http.Request, required Role) (string, int, bool) {
+	user, err := getUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return "", 0, false
+	}
+
+	plotId, err := getPlotId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", 0, false
+	}
+
+	allowed, err := checkPlotPermission(user, plotId, required, env.db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return "", 0, false
+	}
+
+	if !allowed {
+		message := "User is not allowed to view plot data"
+		if required > Viewer {
+			message = "User is not allowed to change plot"
+		}
+		http.Error(w, message, http.StatusForbidden)
+		return "", 0, false
+	}
+
+	return user, plotId, true
 }
 
 func parseDatetime(r *http.Request, key string, defaultValue time.Time) (time.Time, error) {
@@ -182,8 +181,26 @@ func parseResolution(r *http.Request) (Resolution, error) {
 	}
 }
 
+func parseBool(r *http.Request, key string, defaultValue bool) (bool, error) {
+	vars := r.URL.Query()
+	if vals, ok := vars[key]; ok {
+		if len(vals) != 1 {
+			return defaultValue, errors.New("Multiple values for key: " + key)
+		}
+
+		val, err := strconv.ParseBool(vals[0])
+		if err != nil {
+			return defaultValue, errors.New("Invalid boolean: " + key + ": " + vals[0])
+		}
+		return val, nil
+	}
+	return defaultValue, nil
+}
+
 type Env struct {
-	db *Database
+	db             *Database
+	viewerSecret   []byte
+	trustedProxies map[string]bool
 }
 
 func (env *Env) addMeasurements(w http.ResponseWriter, r *http.Request) {
@@ -198,45 +215,67 @@ func (env *Env) addMeasurements(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = env.db.saveMeasurements(measurements, user)
+	apiKey, err := getApiKey(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
-}
 
-func (env *Env) getPlotData(w http.ResponseWriter, r *http.Request) {
+	// Reject the whole batch if any row is outside the scope of the key
+	rejected := checkMeasurementScope(measurements, apiKey)
+	if len(rejected) > 0 {
+		log.WithFields(log.Fields{
+			"id":       user,
+			"key-id":   apiKey.Id,
+			"rejected": len(rejected),
+		}).Warn("Measurements outside scope of api key")
+		jsonData, _ := json.Marshal(ScopeReport{
+			Error:    "Measurements outside scope of api key",
+			Rejected: rejected,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(jsonData)
+		return
+	}
 
-	user, err := getUser(r)
+	err = env.db.saveMeasurements(measurements, user, apiKey.OrganizationId)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	plotId, err := getPlotId(r)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+	if apiKey.OrganizationId == nil {
+		env.autoCreatePlots(user, measurements)
 	}
+	w.WriteHeader(http.StatusCreated)
+}
 
-	// Verify that user is allowed to see plot.
-	isOwner, err := checkIfUserOwnsPlot(user, plotId, env.db)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+func checkMeasurementScope(measurements []Measurement, apiKey *ApiKey) []RejectedMeasurement {
+	rejected := []RejectedMeasurement{}
+	for _, measurement := range measurements {
+		if !apiKey.allowsInstrument(measurement.Key) {
+			rejected = append(rejected, RejectedMeasurement{
+				Key:       measurement.Key,
+				Timestamp: measurement.Timestamp,
+				Reason:    "Instrument key not allowed by api key",
+			})
+		}
 	}
+	return rejected
+}
 
-	if !isOwner {
-		http.Error(w, "User is not allowed to view plot data",
-			http.StatusForbidden)
+func (env *Env) getPlotData(w http.ResponseWriter, r *http.Request) {
+
+	user, plotId, ok := env.checkPlotAccess(w, r, Viewer)
+	if !ok {
 		return
 	}
 
-	getPlotDataAndWriteResponse(w, r, env.db, plotId, user)
+	getPlotDataAndWriteResponse(w, r, env.db, plotId, user, TimeWindow{})
 }
 
-func getPlotDataAndWriteResponse(w http.ResponseWriter, r *http.Request, db *Database, plotId int, id string) {
+func getPlotDataAndWriteResponse(w http.ResponseWriter, r *http.Request, db *Database, plotId int, id string, window TimeWindow) {
 
 	startTime, err := parseDatetime(r, "start", time.Time{})
 	if err != nil {
@@ -256,26 +295,77 @@ func getPlotDataAndWriteResponse(w http.ResponseWriter, r *http.Request, db *Dat
 		return
 	}
 
+	startTime, endTime = window.clamp(startTime, endTime)
+
 	resolution, err := parseResolution(r)
 	if err != nil {
 		http.Error(w, "Incorrect resolution.", http.StatusBadRequest)
 		return
 	}
 
+	smoothing, err := parseSmoothing(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	withAnnotations, err := parseBool(r, "annotations", false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	withExcluded, err := parseBool(r, "include_excluded", false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	start := time.Now()
 	measurements, err := db.readDataFromPlot(plotId, startTime, endTime, resolution)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	var annotations *[]Annotation
+	if withAnnotations {
+		found, err := db.getAnnotations(plotId, TimeWindow{Start: &startTime, End: &endTime})
+		annotations = &found
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var excluded *[]ExcludedReading
+	if withExcluded {
+		found, err := db.readExcludedFromPlot(plotId, startTime, endTime)
+		excluded = &found
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 	dbReadTime := time.Since(start)
 
 	start = time.Now()
-	plots := mapMeasurements(measurements)
+	plots := mapMeasurements(smoothMeasurements(measurements, smoothing))
+	err = addTargetSeries(db, plotId, plots)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	mappingTime := time.Since(start)
 
+	// Otherwise the response stays a plain list of data points
+	var response interface{} = plots
+	if withAnnotations || withExcluded {
+		response = PlotDataResponse{Data: plots, Annotations: annotations, Excluded: excluded}
+	}
+
 	start = time.Now()
-	jsonData, err := json.Marshal(plots)
+	jsonData, err := json.Marshal(response)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -298,38 +388,18 @@ func getPlotDataAndWriteResponse(w http.ResponseWriter, r *http.Request, db *Dat
 }
 
 func (env *Env) getLatestData(w http.ResponseWriter, r *http.Request) {
-	user, err := getUser(r)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	plotId, err := getPlotId(r)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	// Verify that user is allowed to see plot.
-	isOwner, err := checkIfUserOwnsPlot(user, plotId, env.db)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	if !isOwner {
-		http.Error(w, "User is not allowed to view plot data",
-			http.StatusForbidden)
+	_, plotId, ok := env.checkPlotAccess(w, r, Viewer)
+	if !ok {
 		return
 	}
 
-	getPlotLatestDataAndWriteResponse(w, r, env.db, plotId)
+	getPlotLatestDataAndWriteResponse(w, r, env.db, plotId, TimeWindow{})
 }
 
 func getPlotLatestDataAndWriteResponse(w http.ResponseWriter, r *http.Request,
-	db *Database, plotId int) {
+	db *Database, plotId int, window TimeWindow) {
 
-	measurements, err := db.readLatestDataFromPlot(plotId)
+	measurements, err := db.readLatestDataFromPlot(plotId, window)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, "Color not found", http.StatusNotFound)
@@ -340,6 +410,11 @@ func getPlotLatestDataAndWriteResponse(w http.ResponseWriter, r *http.Request,
 	}
 
 	plots := mapMeasurements(measurements)
+	err = addTargetSeries(db, plotId, plots)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	if len(plots) == 0 {
 		// No content to display: have no data yet
@@ -355,54 +430,85 @@ func getPlotLatestDataAndWriteResponse(w http.ResponseWriter, r *http.Request,
 	}
 }
 
-func (env *Env) getPlots(w http.ResponseWriter, r *http.Request) {
+func parseOrganizationFilter(r *http.Request) (*int, error) {
+	vars := r.URL.Query()
+	if vals, ok := vars["organization"]; ok {
+		if len(vals) != 1 {
+			return nil, errors.New("Multiple values for organization")
+		}
 
-	user, err := getUser(r)
+		organizationId, err := strconv.Atoi(vals[0])
+		if err != nil {
+			return nil, errors.New("Invalid organization id: " + vals[0])
+		}
+		return &organizationId, nil
+	}
+	return nil, nil
+}
+
+// Plots can be filtered by organization, style and tags, where a plot must
+// have every tag given. Archived plots are only listed when asked for.
+func parsePlotFilter(r *http.Request) (PlotFilter, error) {
+	organizationId, err := parseOrganizationFilter(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return PlotFilter{}, err
 	}
 
-	plots, err := env.db.getPlots(user)
+	archived, err := parseBool(r, "archived", false)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return PlotFilter{}, err
 	}
-	jsonData, err := json.Marshal(plots)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(jsonData)
+
+	filter := PlotFilter{OrganizationId: organizationId, Archived: archived, Tags: pq.StringArray{}}
+	vars := r.URL.Query()
+	for _, tag := range vars["tag"] {
+		if tag = normalizeTag(tag); tag != "" {
+			filter.Tags = append(filter.Tags, tag)
+		}
+	}
+	if vals, ok := vars["style"]; ok {
+		if len(vals) != 1 {
+			return PlotFilter{}, errors.New("Multiple values for style")
+		}
+		filter.Style = strings.TrimSpace(vals[0])
+	}
+	return filter, nil
 }
 
-func (env *Env) getPlot(w http.ResponseWriter, r *http.Request) {
+func (env *Env) getPlots(w http.ResponseWriter, r *http.Request) {
+
 	user, err := getUser(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	plotId, err := getPlotId(r)
+	filter, err := parsePlotFilter(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Verify that user is allowed to see plot.
-	isOwner, err := checkIfUserOwnsPlot(user, plotId, env.db)
+	plots, err := env.db.getPlots(user, filter)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	jsonData, err := json.Marshal(plots)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
 
-	if !isOwner {
-		http.Error(w, "User is not allowed to view plot data",
-			http.StatusForbidden)
+func (env *Env) getPlot(w http.ResponseWriter, r *http.Request) {
+	_, plotId, ok := env.checkPlotAccess(w, r, Viewer)
+	if !ok {
 		return
 	}
 
-	getPlotAndWriteResponse(w, env.db, plotId)
+	getPlotAndWriteResponse(w, env.db, plotId, TimeWindow{})
 }
 
-func getPlotAndWriteResponse(w http.ResponseWriter, db *Database, plotId int) {
+func getPlotAndWriteResponse(w http.ResponseWriter, db *Database, plotId int, window TimeWindow) {
 	plot, err := db.getPlot(plotId)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -413,9 +519,25 @@ func getPlotAndWriteResponse(w http.ResponseWriter, db *Database, plotId int) {
 		return
 	}
 
+	window.clampPlot(&plot)
+
 	instruments, err := db.getInstruments(plotId)
 	plot.Instruments = instruments
 
+	annotations, err := db.getAnnotations(plotId, window)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	plot.Annotations = annotations
+
+	steps, err := db.getFermentationSteps(plotId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	plot.FermentationSteps = steps
+
 	jsonData, err := json.Marshal(plot)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(jsonData)
@@ -431,13 +553,139 @@ func parsePlot(r *http.Request) (Plot, error) {
 	}
 	defer r.Body.Close()
 
+	report := ValidationReport{Message: "Invalid plot"}
+	plot.Name = strings.TrimSpace(plot.Name)
+	if plot.Name == "" {
+		report.add("name", "must be specified")
+	} else if len(plot.Name) > 255 {
+		report.add("name", "must be at most 255 characters")
+	}
+
+	if plot.StartTime.IsZero() {
+		report.add("startTime", "must be specified")
+	}
 	if plot.EndTime != nil && !plot.StartTime.Before(*plot.EndTime) {
-		return Plot{}, errors.New("Invalid plot: start time must be before end time.")
+		report.add("endTime", "must be after start time")
+	}
+
+	validatePlotMetadata(&plot, &report)
+
+	keys := map[string]bool{}
+	for i, instrument := range plot.Instruments {
+		field := fmt.Sprintf("instruments[%d].", i)
+		instrument = validateInstrument(instrument, field, &report)
+		if instrument.Key != "" && keys[instrument.Key] {
+			report.add(field+"key", "is already used in plot")
+		}
+		keys[instrument.Key] = true
+		plot.Instruments[i] = instrument
 	}
 
+	if len(report.Problems) > 0 {
+		return Plot{}, &report
+	}
 	return plot, nil
 }
 
+const (
+	maxTagLength = 64
+	maxPlotTags  = 20
+)
+
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// Gravity is either specific gravity (1.050) or points (1050).
+func validGravity(gravity float64, unit string) bool {
+	if unit == "points" {
+		return gravity >= 980 && gravity < 1200
+	}
+	return gravity >= 0.98 && gravity < 1.2
+}
+
+func validatePlotMetadata(plot *Plot, report *ValidationReport) {
+	plot.Style = strings.TrimSpace(plot.Style)
+	plot.Recipe = strings.TrimSpace(plot.Recipe)
+	plot.Yeast = strings.TrimSpace(plot.Yeast)
+	if len(plot.Style) > 255 {
+		report.add("style", "must be at most 255 characters")
+	}
+	if len(plot.Recipe) > 255 {
+		report.add("recipe", "must be at most 255 characters")
+	}
+	if len(plot.Yeast) > 255 {
+		report.add("yeast", "must be at most 255 characters")
+	}
+
+	if plot.BatchSize != nil && (*plot.BatchSize <= 0 || *plot.BatchSize > 100000) {
+		report.add("batchSize", "must be between 0 and 100000")
+	}
+	if plot.GravityUnit == "" {
+		plot.GravityUnit = "sg"
+	}
+	if plot.TemperatureUnit == "" {
+		plot.TemperatureUnit = "C"
+	}
+	if plot.GravityUnit != "sg" && plot.GravityUnit != "points" {
+		report.add("gravityUnit", "must be sg or points")
+	}
+	if plot.TemperatureUnit != "C" && plot.TemperatureUnit != "F" {
+		report.add("temperatureUnit", "must be C or F")
+	}
+
+	if plot.TargetOG != nil && !validGravity(*plot.TargetOG, plot.GravityUnit) {
+		report.add("targetOg", "must be a gravity in "+plot.GravityUnit)
+	}
+	if plot.TargetFG != nil && !validGravity(*plot.TargetFG, plot.GravityUnit) {
+		report.add("targetFg", "must be a gravity in "+plot.GravityUnit)
+	}
+	if plot.TargetOG != nil && plot.TargetFG != nil && *plot.TargetFG >= *plot.TargetOG {
+		report.add("targetFg", "must be below target og")
+	}
+	if plot.TargetTempMin != nil && (*plot.TargetTempMin < -20 || *plot.TargetTempMin > 120) {
+		report.add("targetTempMin", "must be between -20 and 120")
+	}
+	if plot.TargetTempMax != nil && (*plot.TargetTempMax < -20 || *plot.TargetTempMax > 120) {
+		report.add("targetTempMax", "must be between -20 and 120")
+	}
+	if plot.TargetTempMin != nil && plot.TargetTempMax != nil && *plot.TargetTempMin > *plot.TargetTempMax {
+		report.add("targetTempMax", "must not be below target temp min")
+	}
+
+	tags := pq.StringArray{}
+	seen := map[string]bool{}
+	for _, tag := range plot.Tags {
+		tag = normalizeTag(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > maxTagLength {
+			report.add("tags", "must be at most 64 characters each")
+			break
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	if len(tags) > maxPlotTags {
+		report.add("tags", "must be at most 20")
+	}
+	plot.Tags = tags
+}
+
+// Write validation reports as JSON, so that clients can show every problem
+// at once, and any other error as text.
+func writeRequestError(w http.ResponseWriter, err error, status int) {
+	if report, ok := err.(*ValidationReport); ok {
+		jsonData, _ := json.Marshal(report)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(jsonData)
+		return
+	}
+	http.Error(w, err.Error(), status)
+}
+
 func (env *Env) addPlot(w http.ResponseWriter, r *http.Request) {
 
 	user, err := getUser(r)
@@ -448,7 +696,11 @@ func (env *Env) addPlot(w http.ResponseWriter, r *http.Request) {
 
 	plot, err := parsePlot(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeRequestError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if !env.checkOrganizationPlot(w, user, plot.OrganizationId) {
 		return
 	}
 
@@ -463,6 +715,27 @@ func (env *Env) addPlot(w http.ResponseWriter, r *http.Request) {
 	w.Write(jsonData)
 }
 
+// Plots can be created for organizations the user edits. Writes an error
+// response if the user may not.
+func (env *Env) checkOrganizationPlot(w http.ResponseWriter, user string, organizationId *int) bool {
+	if organizationId == nil {
+		return true
+	}
+
+	role, err := env.db.getOrganizationRole(user, *organizationId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	if role < Editor {
+		http.Error(w, "User is not allowed to add plots to organization",
+			http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
 func (env *Env) updatePlot(w http.ResponseWriter, r *http.Request) {
 
 	user, err := getUser(r)
@@ -473,7 +746,7 @@ func (env *Env) updatePlot(w http.ResponseWriter, r *http.Request) {
 
 	plot, err := parsePlot(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeRequestError(w, err, http.StatusBadRequest)
 		return
 	}
 
@@ -484,6 +757,18 @@ func (env *Env) updatePlot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	allowed, err := checkPlotPermission(user, plotId, Editor, env.db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !allowed {
+		http.Error(w, "User is not allowed to change plot",
+			http.StatusForbidden)
+		return
+	}
+
 	plot.Id = plotId
 
 	updated_plot, err := env.db.updatePlot(plot, user)
@@ -498,68 +783,169 @@ func (env *Env) updatePlot(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func (env *Env) addShareLink(w http.ResponseWriter, r *http.Request) {
+// The expected interval between readings can be given in seconds, for
+// loggers that are known to send at a fixed rate.
+func (env *Env) getPlotSummary(w http.ResponseWriter, r *http.Request) {
+	_, plotId, ok := env.checkPlotAccess(w, r, Viewer)
+	if !ok {
+		return
+	}
 
-	user, err := getUser(r)
+	var expectedInterval *float64
+	if val := r.URL.Query().Get("interval"); val != "" {
+		interval, err := strconv.ParseFloat(val, 64)
+		if err != nil || interval <= 0 {
+			http.Error(w, "Invalid interval: "+val, http.StatusBadRequest)
+			return
+		}
+		expectedInterval = &interval
+	}
+
+	summaries, err := env.db.getPlotSummary(plotId, expectedInterval)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	plotId, err := getPlotId(r)
+	jsonData, _ := json.Marshal(summaries)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+func (env *Env) deletePlot(w http.ResponseWriter, r *http.Request) {
+	user, plotId, ok := env.checkPlotAccess(w, r, Owner)
+	if !ok {
+		return
+	}
+
+	purge, err := parseBool(r, "purge", false)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Verify that user is allowed to see plot.
-	isOwner, err := checkIfUserOwnsPlot(user, plotId, env.db)
+	err = env.db.deletePlot(plotId, purge, user)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if !isOwner {
-		http.Error(w, "User is not allowed to view plot",
-			http.StatusForbidden)
+	log.WithFields(log.Fields{
+		"id":      user,
+		"plot-id": plotId,
+		"purge":   purge,
+	}).Info("Deleted plot")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (env *Env) setPlotArchived(w http.ResponseWriter, r *http.Request, archived bool) {
+	_, plotId, ok := env.checkPlotAccess(w, r, Editor)
+	if !ok {
 		return
 	}
 
-	shareLink, err := env.db.addShareLink(plotId, user)
+	err := env.db.setPlotArchived(plotId, archived)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	jsonData, _ := json.Marshal(shareLink)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(jsonData)
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func (env *Env) getShareLink(w http.ResponseWriter, r *http.Request) {
-	user, err := getUser(r)
+func (env *Env) archivePlot(w http.ResponseWriter, r *http.Request) {
+	env.setPlotArchived(w, r, true)
+}
+
+func (env *Env) unarchivePlot(w http.ResponseWriter, r *http.Request) {
+	env.setPlotArchived(w, r, false)
+}
+
+// The body is optional: without it the link never expires and shows the
+// whole plot.
+func parseShareLink(r *http.Request) (ShareLink, error) {
+	decoder := json.NewDecoder(r.Body)
+	var shareLink ShareLink
+	err := decoder.Decode(&shareLink)
+	if err == io.EOF {
+		return ShareLink{}, nil
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return ShareLink{}, err
+	}
+	defer r.Body.Close()
+
+	// Only accept the fields the user can set
+	shareLink = ShareLink{
+		Label:       strings.TrimSpace(shareLink.Label),
+		ExpiresAt:   shareLink.ExpiresAt,
+		WindowStart: shareLink.WindowStart,
+		WindowEnd:   shareLink.WindowEnd,
+		Password:    shareLink.Password,
+	}
+
+	if len(shareLink.Label) > 255 {
+		return ShareLink{}, errors.New("Invalid share link: label is too long.")
+	}
+
+	if shareLink.ExpiresAt != nil && !shareLink.ExpiresAt.After(time.Now()) {
+		return ShareLink{}, errors.New("Invalid share link: expiry must be in the future.")
+	}
+
+	if shareLink.WindowStart != nil && shareLink.WindowEnd != nil &&
+		!shareLink.WindowStart.Before(*shareLink.WindowEnd) {
+		return ShareLink{}, errors.New("Invalid share link: window start must be before window end.")
+	}
+
+	// Stored without time zone, like the rest of the timestamps
+	for _, t := range []*time.Time{shareLink.ExpiresAt, shareLink.WindowStart, shareLink.WindowEnd} {
+		if t != nil {
+			*t = t.UTC()
+		}
+	}
+
+	return shareLink, nil
+}
+
+func (env *Env) addShareLink(w http.ResponseWriter, r *http.Request) {
+
+	user, plotId, ok := env.checkPlotAccess(w, r, Editor)
+	if !ok {
 		return
 	}
 
-	plotId, err := getPlotId(r)
+	shareLink, err := parseShareLink(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Verify that user is allowed to see plot.
-	isOwner, err := checkIfUserOwnsPlot(user, plotId, env.db)
+	if shareLink.Password != "" {
+		shareLink.PasswordHash, err = hashSharePassword(shareLink.Password)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		shareLink.Protected = true
+		shareLink.Password = ""
+	}
+
+	shareLink, err = env.db.addShareLink(shareLink, plotId, user)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if !isOwner {
-		http.Error(w, "User is not allowed to view plot data",
-			http.StatusForbidden)
+	jsonData, _ := json.Marshal(shareLink)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+func (env *Env) getShareLink(w http.ResponseWriter, r *http.Request) {
+	user, plotId, ok := env.checkPlotAccess(w, r, Editor)
+	if !ok {
 		return
 	}
 
@@ -580,40 +966,69 @@ func (env *Env) getShareLink(w http.ResponseWriter, r *http.Request) {
 }
 
 func (env *Env) removeShareLink(w http.ResponseWriter, r *http.Request) {
-	user, err := getUser(r)
+	user, plotId, ok := env.checkPlotAccess(w, r, Editor)
+	if !ok {
+		return
+	}
+
+	err := env.db.removeShareLink(plotId, user)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	plotId, err := getPlotId(r)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (env *Env) getShareLinks(w http.ResponseWriter, r *http.Request) {
+	_, plotId, ok := env.checkPlotAccess(w, r, Editor)
+	if !ok {
 		return
 	}
 
-	// Verify that user is allowed to see plot.
-	isOwner, err := checkIfUserOwnsPlot(user, plotId, env.db)
+	shareLinks, err := env.db.getShareLinks(plotId)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if !isOwner {
-		http.Error(w, "User is not allowed to view plot data",
-			http.StatusForbidden)
+	jsonData, _ := json.Marshal(shareLinks)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+func (env *Env) removeShareLinkByUuid(w http.ResponseWriter, r *http.Request) {
+	_, plotId, ok := env.checkPlotAccess(w, r, Editor)
+	if !ok {
 		return
 	}
 
-	err = env.db.removeShareLink(plotId, user)
+	removed, err := env.db.removeShareLinkByUuid(plotId, mux.Vars(r)["uuid"])
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if !removed {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// Access statistics are best effort and never fail the request.
+func (env *Env) recordShareLinkAccess(shareLink *ShareLink, dataRequest bool) {
+	err := env.db.recordShareLinkAccess(shareLink.Uuid, dataRequest)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"uuid": shareLink.Uuid,
+		}).Warn("Unable to record share link access")
+	}
+}
+
 func (env *Env) getSharedPlot(w http.ResponseWriter, r *http.Request) {
 	shareLink, err := env.getShareLinkFromUuid(r)
 	if err != nil {
@@ -627,7 +1042,12 @@ func (env *Env) getSharedPlot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	getPlotAndWriteResponse(w, env.db, shareLink.PlotId)
+	if !env.checkViewerAccess(w, r, shareLink) {
+		return
+	}
+
+	env.recordShareLinkAccess(shareLink, false)
+	getPlotAndWriteResponse(w, env.db, shareLink.PlotId, shareLink.window())
 }
 
 func (env *Env) getSharedPlotData(w http.ResponseWriter, r *http.Request) {
@@ -643,8 +1063,13 @@ func (env *Env) getSharedPlotData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !env.checkViewerAccess(w, r, shareLink) {
+		return
+	}
+
+	env.recordShareLinkAccess(shareLink, true)
 	getPlotDataAndWriteResponse(w, r, env.db, shareLink.PlotId,
-		shareLink.Uuid)
+		shareLink.Uuid, shareLink.window())
 }
 
 func (env *Env) getSharedPlotLatestData(w http.ResponseWriter, r *http.Request) {
@@ -660,7 +1085,200 @@ func (env *Env) getSharedPlotLatestData(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	getPlotLatestDataAndWriteResponse(w, r, env.db, shareLink.PlotId)
+	if !env.checkViewerAccess(w, r, shareLink) {
+		return
+	}
+
+	env.recordShareLinkAccess(shareLink, true)
+	getPlotLatestDataAndWriteResponse(w, r, env.db, shareLink.PlotId, shareLink.window())
+}
+
+func (env *Env) checkIfKeyCanReadPlot(w http.ResponseWriter, r *http.Request) (int, bool) {
+	apiKey, err := getApiKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return 0, false
+	}
+
+	plotId, err := getPlotId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return 0, false
+	}
+
+	if !apiKey.allowsReadingPlot(plotId) {
+		http.Error(w, "Key is not allowed to view plot data",
+			http.StatusForbidden)
+		return 0, false
+	}
+
+	// The key owner may have lost access since the key was created
+	allowed, err := env.checkKeyCanAccessPlot(apiKey, plotId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return 0, false
+	}
+
+	if !allowed {
+		http.Error(w, "Key is not allowed to view plot data",
+			http.StatusForbidden)
+		return 0, false
+	}
+
+	return plotId, true
+}
+
+// Organization keys can access the plots of the organization, other keys
+// the plots the user that created them can see.
+func (env *Env) checkKeyCanAccessPlot(apiKey *ApiKey, plotId int) (bool, error) {
+	if apiKey.OrganizationId == nil {
+		return checkPlotPermission(apiKey.Login, plotId, Viewer, env.db)
+	}
+
+	plot, err := env.db.getPlot(plotId)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return plot.OrganizationId != nil && *plot.OrganizationId == *apiKey.OrganizationId, nil
+}
+
+func (env *Env) getKeyPlotData(w http.ResponseWriter, r *http.Request) {
+	plotId, ok := env.checkIfKeyCanReadPlot(w, r)
+	if !ok {
+		return
+	}
+
+	apiKey, _ := getApiKey(r)
+	getPlotDataAndWriteResponse(w, r, env.db, plotId, apiKey.Login, TimeWindow{})
+}
+
+func (env *Env) getKeyPlotLatestData(w http.ResponseWriter, r *http.Request) {
+	plotId, ok := env.checkIfKeyCanReadPlot(w, r)
+	if !ok {
+		return
+	}
+
+	getPlotLatestDataAndWriteResponse(w, r, env.db, plotId, TimeWindow{})
+}
+
+func parseApiKey(r *http.Request) (ApiKey, error) {
+	decoder := json.NewDecoder(r.Body)
+	var apiKey ApiKey
+	err := decoder.Decode(&apiKey)
+	if err != nil {
+		return ApiKey{}, err
+	}
+	defer r.Body.Close()
+
+	for _, pattern := range apiKey.InstrumentPatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return ApiKey{}, errors.New("Invalid instrument pattern: " + pattern)
+		}
+	}
+
+	return apiKey, nil
+}
+
+func getApiKeyId(r *http.Request) (int, error) {
+	vars := mux.Vars(r)
+	keyId, err := strconv.Atoi(vars["keyId"])
+	if err != nil {
+		return keyId, errors.New("Invalid key id: " + vars["keyId"])
+	}
+
+	return keyId, err
+}
+
+func (env *Env) getApiKeys(w http.ResponseWriter, r *http.Request) {
+	user, err := getUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	apiKeys, err := env.db.getApiKeys(user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jsonData, _ := json.Marshal(apiKeys)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+func (env *Env) addApiKey(w http.ResponseWriter, r *http.Request) {
+	user, err := getUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	env.createApiKeyAndWriteResponse(w, r, user, nil)
+}
+
+func (env *Env) createApiKeyAndWriteResponse(w http.ResponseWriter, r *http.Request, user string, organizationId *int) {
+	apiKey, err := parseApiKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	apiKey.Login = user
+	apiKey.OrganizationId = organizationId
+
+	// Read access can only be granted to plots the key could see anyway
+	for _, plotId := range apiKey.ReadPlots {
+		allowed, err := env.checkKeyCanAccessPlot(&apiKey, int(plotId))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !allowed {
+			http.Error(w, "User is not allowed to share plot "+strconv.Itoa(int(plotId)),
+				http.StatusForbidden)
+			return
+		}
+	}
+
+	created, err := env.db.addApiKey(apiKey, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jsonData, _ := json.Marshal(created)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonData)
+}
+
+func (env *Env) removeApiKey(w http.ResponseWriter, r *http.Request) {
+	user, err := getUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	keyId, err := getApiKeyId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	removed, err := env.db.removeApiKey(keyId, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !removed {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (env *Env) getKey(w http.ResponseWriter, r *http.Request) {
@@ -704,18 +1322,40 @@ func main() {
 	}
 
 	database := &Database{db: db}
-	env := &Env{db: database}
+	viewerSecret, err := viewerTokenSecret()
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Fatal("Unable to create secret for viewer tokens")
+	}
+	env := &Env{db: database, viewerSecret: viewerSecret, trustedProxies: trustedProxies()}
+
+	//read trusted issuers, defaults to google jwt from firebase
+	issuers, err := loadIssuers(os.Getenv("JWT_ISSUERS"))
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Fatal("Unable to load trusted issuers")
+	}
 
-	//create middleware for authing on google jwt from firebase
+	//optionally issue our own tokens for username/password users
+	var localAuth *LocalAuth
+	if keyFile := os.Getenv("LOCAL_AUTH_KEY_FILE"); keyFile != "" {
+		localAuth, err = newLocalAuth(database, keyFile, os.Getenv("LOCAL_AUTH_ISSUER"))
+		if err != nil {
+			log.WithFields(log.Fields{"err": err}).Fatal("Unable to set up local authentication")
+		}
+		issuers = append(issuers, localAuth.trustedIssuer())
+	}
+
+	//create middleware for authing on jwt from the trusted issuers
 	jwtMiddleware := jwtmiddleware.New(jwtmiddleware.Options{
-		ValidationKeyGetter: func(token *jwt.Token) (interface{}, error) {
-			key, err := getKey(token.Header["kid"].(string))
-			return key, err
-		},
-		SigningMethod: jwt.SigningMethodRS256,
+		ValidationKeyGetter: issuers.getValidationKey,
+		SigningMethod:       jwt.SigningMethodRS256,
 	})
 
-	jwtCheckHandler := &JwtCheckHandler{db: database, jwtMiddleware: jwtMiddleware}
+	jwtCheckHandler := &JwtCheckHandler{
+		db:            database,
+		jwtMiddleware: jwtMiddleware,
+		issuers:       issuers,
+		localAuth:     localAuth,
+	}
 	keyCheckHandler := &KeyCheckHandler{db: database}
 
 	//define routes
@@ -729,18 +1369,66 @@ func main() {
 		negroni.Wrap(measurementRouter),
 	))
 
+	keyPlotsRouter := mux.NewRouter()
+	keyPlotsRouter.HandleFunc("/keyplots/{plotId}/data/", env.getKeyPlotData).Methods("GET")
+	keyPlotsRouter.HandleFunc("/keyplots/{plotId}/data/latest/", env.getKeyPlotLatestData).Methods("GET")
+	router.PathPrefix("/keyplots").Handler(negroni.New(
+		keyCheckHandler,
+		negroni.Wrap(keyPlotsRouter),
+	))
+
+	controllerRouter := mux.NewRouter()
+	controllerRouter.HandleFunc("/controller/{plotId}/setpoint", env.getSetpoint).Methods("GET")
+	router.PathPrefix("/controller").Handler(negroni.New(
+		keyCheckHandler,
+		negroni.Wrap(controllerRouter),
+	))
+
 	plotsRouter := mux.NewRouter()
 	plotsRouter.HandleFunc("/plots/{plotId}/data/", env.getPlotData).Methods("GET")
 	plotsRouter.HandleFunc("/plots/{plotId}/data/latest/", env.getLatestData).Methods("GET")
+	plotsRouter.HandleFunc("/plots/{plotId}/summary/", env.getPlotSummary).Methods("GET")
+	plotsRouter.HandleFunc("/plots/{plotId}/outliers/", env.detectOutliers).Methods("POST")
+	plotsRouter.HandleFunc("/plots/{plotId}/readings/exclude/", env.excludeReadings).Methods("POST")
+	plotsRouter.HandleFunc("/plots/{plotId}/readings/include/", env.includeReadings).Methods("POST")
 
 	plotsRouter.HandleFunc("/plots/", env.getPlots).Methods("GET")
+	plotsRouter.HandleFunc("/plots/compare/", env.comparePlots).Methods("GET")
+	plotsRouter.HandleFunc("/plots/recipe/", env.addRecipePlot).Methods("POST")
 	plotsRouter.HandleFunc("/plots/{plotId}", env.getPlot).Methods("GET")
 	plotsRouter.HandleFunc("/plots/", env.addPlot).Methods("POST")
 	plotsRouter.HandleFunc("/plots/{plotId}", env.updatePlot).Methods("PUT")
+	plotsRouter.HandleFunc("/plots/{plotId}", env.deletePlot).Methods("DELETE")
+	plotsRouter.HandleFunc("/plots/{plotId}/archive/", env.archivePlot).Methods("POST")
+	plotsRouter.HandleFunc("/plots/{plotId}/archive/", env.unarchivePlot).Methods("DELETE")
+	plotsRouter.HandleFunc("/plots/{plotId}/annotations/", env.getAnnotations).Methods("GET")
+	plotsRouter.HandleFunc("/plots/{plotId}/annotations/", env.addAnnotation).Methods("POST")
+	plotsRouter.HandleFunc("/plots/{plotId}/annotations/{annotationId}", env.updateAnnotation).Methods("PUT")
+	plotsRouter.HandleFunc("/plots/{plotId}/annotations/{annotationId}", env.removeAnnotation).Methods("DELETE")
+	plotsRouter.HandleFunc("/plots/{plotId}/recipe/", env.importRecipe).Methods("POST")
+	plotsRouter.HandleFunc("/plots/{plotId}/profile/", env.getProfile).Methods("GET")
+	plotsRouter.HandleFunc("/plots/{plotId}/profile/", env.updateProfile).Methods("PUT")
+	plotsRouter.HandleFunc("/plots/{plotId}/autoclose/", env.getAutoClosePolicy).Methods("GET")
+	plotsRouter.HandleFunc("/plots/{plotId}/autoclose/", env.updateAutoClosePolicy).Methods("PUT")
+
+	plotsRouter.HandleFunc("/plots/{plotId}/instruments/", env.getPlotInstruments).Methods("GET")
+	plotsRouter.HandleFunc("/plots/{plotId}/instruments/", env.addInstrument).Methods("POST")
+	plotsRouter.HandleFunc("/plots/{plotId}/instruments/{instrumentId}", env.updateInstrument).Methods("PUT")
+	plotsRouter.HandleFunc("/plots/{plotId}/instruments/{instrumentId}", env.removeInstrument).Methods("DELETE")
 
 	plotsRouter.HandleFunc("/plots/{plotId}/sharelink/", env.getShareLink).Methods("GET")
 	plotsRouter.HandleFunc("/plots/{plotId}/sharelink/", env.addShareLink).Methods("POST")
 	plotsRouter.HandleFunc("/plots/{plotId}/sharelink/", env.removeShareLink).Methods("DELETE")
+	plotsRouter.HandleFunc("/plots/{plotId}/sharelinks/", env.getShareLinks).Methods("GET")
+	plotsRouter.HandleFunc("/plots/{plotId}/sharelinks/", env.addShareLink).Methods("POST")
+	plotsRouter.HandleFunc("/plots/{plotId}/sharelinks/{uuid}", env.removeShareLinkByUuid).Methods("DELETE")
+
+	plotsRouter.HandleFunc("/plots/{plotId}/members/", env.getPlotMembers).Methods("GET")
+	plotsRouter.HandleFunc("/plots/{plotId}/members/{memberId}", env.updatePlotMember).Methods("PUT")
+	plotsRouter.HandleFunc("/plots/{plotId}/members/{memberId}", env.removePlotMember).Methods("DELETE")
+	plotsRouter.HandleFunc("/plots/{plotId}/invitations/", env.getPlotInvitations).Methods("GET")
+	plotsRouter.HandleFunc("/plots/{plotId}/invitations/", env.addPlotInvitation).Methods("POST")
+	plotsRouter.HandleFunc("/plots/{plotId}/invitations/{invitationId}", env.removePlotInvitation).Methods("DELETE")
 	router.PathPrefix("/plots").Handler(negroni.New(
 		jwtCheckHandler,
 		negroni.Wrap(plotsRouter),
@@ -748,14 +1436,66 @@ func main() {
 
 	sharedLinkRouter := mux.NewRouter()
 	sharedLinkRouter.HandleFunc("/sharedplots/{uuid}/", env.getSharedPlot).Methods("GET")
+	sharedLinkRouter.HandleFunc("/sharedplots/{uuid}/unlock/", env.unlockSharedPlot).Methods("POST")
 	sharedLinkRouter.HandleFunc("/sharedplots/{uuid}/data/", env.getSharedPlotData).Methods("GET")
 	sharedLinkRouter.HandleFunc("/sharedplots/{uuid}/data/latest/", env.getSharedPlotLatestData).Methods("GET")
+	sharedLinkRouter.HandleFunc("/sharedplots/{uuid}/annotations/", env.getSharedAnnotations).Methods("GET")
 	router.PathPrefix("/sharedplots").Handler(negroni.New(
 		negroni.Wrap(sharedLinkRouter),
 	))
 
+	if localAuth != nil {
+		authRouter := mux.NewRouter()
+		authRouter.HandleFunc("/auth/register/", localAuth.register).Methods("POST")
+		authRouter.HandleFunc("/auth/login/", localAuth.login).Methods("POST")
+		authRouter.HandleFunc("/auth/refresh/", localAuth.refresh).Methods("POST")
+		authRouter.HandleFunc("/auth/logout/", localAuth.logout).Methods("POST")
+		router.PathPrefix("/auth").Handler(negroni.New(
+			negroni.Wrap(authRouter),
+		))
+	}
+
+	deviceRouter := mux.NewRouter()
+	deviceRouter.HandleFunc("/device/code/", env.requestDeviceCode).Methods("POST")
+	deviceRouter.HandleFunc("/device/token/", env.pollDeviceToken).Methods("POST")
+	router.PathPrefix("/device").Handler(negroni.New(
+		negroni.Wrap(deviceRouter),
+	))
+
+	organizationRouter := mux.NewRouter()
+	organizationRouter.HandleFunc("/organizations/", env.getOrganizations).Methods("GET")
+	organizationRouter.HandleFunc("/organizations/", env.addOrganization).Methods("POST")
+	organizationRouter.HandleFunc("/organizations/{organizationId}/members/", env.getOrganizationMembers).Methods("GET")
+	organizationRouter.HandleFunc("/organizations/{organizationId}/members/", env.addOrganizationMember).Methods("POST")
+	organizationRouter.HandleFunc("/organizations/{organizationId}/members/{memberId}", env.updateOrganizationMember).Methods("PUT")
+	organizationRouter.HandleFunc("/organizations/{organizationId}/members/{memberId}", env.removeOrganizationMember).Methods("DELETE")
+	organizationRouter.HandleFunc("/organizations/{organizationId}/keys/", env.getOrganizationApiKeys).Methods("GET")
+	organizationRouter.HandleFunc("/organizations/{organizationId}/keys/", env.addOrganizationApiKey).Methods("POST")
+	organizationRouter.HandleFunc("/organizations/{organizationId}/keys/{keyId}", env.removeOrganizationApiKey).Methods("DELETE")
+	router.PathPrefix("/organizations").Handler(negroni.New(
+		jwtCheckHandler,
+		negroni.Wrap(organizationRouter),
+	))
+
 	userRouter := mux.NewRouter()
 	userRouter.HandleFunc("/user/key/", env.getKey).Methods("GET")
+	userRouter.HandleFunc("/user/keys/", env.getApiKeys).Methods("GET")
+	userRouter.HandleFunc("/user/keys/", env.addApiKey).Methods("POST")
+	userRouter.HandleFunc("/user/keys/{keyId}", env.removeApiKey).Methods("DELETE")
+	userRouter.HandleFunc("/user/devices/{userCode}", env.getDeviceAuthorization).Methods("GET")
+	userRouter.HandleFunc("/user/devices/{userCode}/approve/", env.approveDevice).Methods("POST")
+	userRouter.HandleFunc("/user/devices/{userCode}/deny/", env.denyDevice).Methods("POST")
+	userRouter.HandleFunc("/user/instruments/", env.getDiscoveredInstruments).Methods("GET")
+	userRouter.HandleFunc("/user/autoplot/", env.getAutoPlotRule).Methods("GET")
+	userRouter.HandleFunc("/user/autoplot/", env.updateAutoPlotRule).Methods("PUT")
+	userRouter.HandleFunc("/user/notifications/", env.getNotifications).Methods("GET")
+	userRouter.HandleFunc("/user/notifications/{notificationId}/read/", env.markNotificationRead).Methods("POST")
+	userRouter.HandleFunc("/user/measurements/", env.getMeasurements).Methods("GET")
+	userRouter.HandleFunc("/user/measurements/", env.deleteMeasurements).Methods("DELETE")
+	userRouter.HandleFunc("/user/measurements/audit/", env.getMeasurementAudit).Methods("GET")
+	userRouter.HandleFunc("/user/measurements/{measurementId}", env.updateMeasurement).Methods("PUT")
+	userRouter.HandleFunc("/user/invitations/", env.getUserInvitations).Methods("GET")
+	userRouter.HandleFunc("/user/invitations/{invitationId}/accept/", env.acceptInvitation).Methods("POST")
 
 	router.PathPrefix("/user").Handler(negroni.New(
 		jwtCheckHandler,
@@ -766,9 +1506,11 @@ func main() {
 	c := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
 		AllowedHeaders: []string{"Content-Type", "Authorization"},
-		AllowedMethods: []string{"GET", "HEAD", "POST", "PUT", "OPTIONS"},
+		AllowedMethods: []string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS"},
 	})
 
+	go env.runAutoClose(autoCloseInterval)
+
 	n := negroni.New()
 	n.Use(negronilogrus.NewMiddleware())
 	n.Use(c)
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Upper bound on the number of raw measurements or audit entries returned
+const maxRawMeasurements = 10000
+
+// A page of raw measurements. When truncated, the next page is read with
+// next as start.
+type MeasurementPage struct {
+	Measurements []RawMeasurement `json:"measurements"`
+	Truncated    bool             `json:"truncated"`
+	Next         *time.Time       `json:"next,omitempty"`
+}
+
+// The most recent changes, truncated when there are more than fit a page.
+type MeasurementAuditPage struct {
+	Entries   []MeasurementAudit `json:"entries"`
+	Truncated bool               `json:"truncated"`
+}
+
+type MeasurementDeletion struct {
+	Deleted int64 `json:"deleted"`
+}
+
+type MeasurementCorrection struct {
+	Value *float64 `json:"value"`
+}
+
+// Split the measurements read with one more than the page size into a page.
+// A page ends before the first measurement of the next page, and before any
+// measurements at the same time, so that paging by time does not repeat
+// them.
+func measurementPage(measurements []RawMeasurement, size int) MeasurementPage {
+	if len(measurements) <= size {
+		return MeasurementPage{Measurements: measurements}
+	}
+
+	next := measurements[size].Timestamp
+	end := size
+	for end > 0 && measurements[end-1].Timestamp.Equal(next) {
+		end--
+	}
+	if end == 0 {
+		// A page of readings at a single time
+		end = size
+	}
+	return MeasurementPage{Measurements: measurements[:end], Truncated: true, Next: &next}
+}
+
+func getMeasurementId(r *http.Request) (int64, error) {
+	vars := mux.Vars(r)
+	measurementId, err := strconv.ParseInt(vars["measurementId"], 10, 64)
+	if err != nil {
+		return measurementId, errors.New("Invalid measurement id: " + vars["measurementId"])
+	}
+
+	return measurementId, err
+}
+
+// Get the user from the request, and the organization whose measurements
+// are asked for, if any. Measurements sent with the keys of an organization
+// can be edited by its editors and owners.
+func (env *Env) checkMeasurementAccess(w http.ResponseWriter, r *http.Request) (string, *int, bool) {
+	user, err := getUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return "", nil, false
+	}
+
+	organizationId, err := parseOrganizationFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", nil, false
+	}
+
+	if organizationId != nil {
+		role, err := env.db.getOrganizationRole(user, *organizationId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return "", nil, false
+		}
+
+		if role < Editor {
+			http.Error(w, "User is not allowed to edit measurements of organization",
+				http.StatusForbidden)
+			return "", nil, false
+		}
+	}
+	return user, organizationId, true
+}
+
+// Parse the key and time range selecting raw measurements. When required,
+// the range must be given explicitly, so that a request can not remove all
+// measurements of a key by mistake.
+func parseMeasurementRange(r *http.Request, keyRequired bool, rangeRequired bool) (string, time.Time, time.Time, error) {
+	key := r.URL.Query().Get("key")
+	if keyRequired && key == "" {
+		return "", time.Time{}, time.Time{}, errors.New("Missing key")
+	}
+
+	if rangeRequired && (r.URL.Query().Get("start") == "" || r.URL.Query().Get("end") == "") {
+		return "", time.Time{}, time.Time{}, errors.New("Missing start or end")
+	}
+
+	start, err := parseDatetime(r, "start", time.Unix(0, 0))
+	if err != nil {
+		return "", time.Time{}, time.Time{}, err
+	}
+
+	end, err := parseDatetime(r, "end", time.Now())
+	if err != nil {
+		return "", time.Time{}, time.Time{}, err
+	}
+
+	if end.Before(start) {
+		return "", time.Time{}, time.Time{}, errors.New("End must be after start")
+	}
+	return key, start, end, nil
+}
+
+func (env *Env) getMeasurements(w http.ResponseWriter, r *http.Request) {
+	user, organizationId, ok := env.checkMeasurementAccess(w, r)
+	if !ok {
+		return
+	}
+
+	key, start, end, err := parseMeasurementRange(r, true, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	measurements, err := env.db.readMeasurements(user, organizationId, key, start, end, maxRawMeasurements+1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, _ := json.Marshal(measurementPage(measurements, maxRawMeasurements))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+func (env *Env) deleteMeasurements(w http.ResponseWriter, r *http.Request) {
+	user, organizationId, ok := env.checkMeasurementAccess(w, r)
+	if !ok {
+		return
+	}
+
+	key, start, end, err := parseMeasurementRange(r, true, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := env.db.deleteMeasurements(user, organizationId, key, start, end)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"id":      user,
+		"key":     key,
+		"start":   start,
+		"end":     end,
+		"deleted": deleted,
+	}).Info("Deleted measurements")
+
+	jsonData, _ := json.Marshal(MeasurementDeletion{Deleted: deleted})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+func (env *Env) updateMeasurement(w http.ResponseWriter, r *http.Request) {
+	user, organizationId, ok := env.checkMeasurementAccess(w, r)
+	if !ok {
+		return
+	}
+
+	measurementId, err := getMeasurementId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var correction MeasurementCorrection
+	err = decoder.Decode(&correction)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if correction.Value == nil {
+		http.Error(w, "Missing value", http.StatusBadRequest)
+		return
+	}
+
+	measurement, err := env.db.updateMeasurement(user, organizationId, measurementId, *correction.Value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if measurement == nil {
+		http.Error(w, "Measurement not found", http.StatusNotFound)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"id":             user,
+		"measurement-id": measurementId,
+		"value":          *correction.Value,
+	}).Info("Corrected measurement")
+
+	jsonData, _ := json.Marshal(measurement)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+func (env *Env) getMeasurementAudit(w http.ResponseWriter, r *http.Request) {
+	user, organizationId, ok := env.checkMeasurementAccess(w, r)
+	if !ok {
+		return
+	}
+
+	key, start, end, err := parseMeasurementRange(r, false, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries, err := env.db.getMeasurementAudit(user, organizationId, key, start, end, maxRawMeasurements+1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page := MeasurementAuditPage{Entries: entries}
+	if len(entries) > maxRawMeasurements {
+		page = MeasurementAuditPage{Entries: entries[:maxRawMeasurements], Truncated: true}
+	}
+	jsonData, _ := json.Marshal(page)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
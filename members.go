@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type MemberRoleRequest struct {
+	Role Role `json:"role"`
+}
+
+func getInvitationId(r *http.Request) (int, error) {
+	vars := mux.Vars(r)
+	invitationId, err := strconv.Atoi(vars["invitationId"])
+	if err != nil {
+		return invitationId, errors.New("Invalid invitation id: " + vars["invitationId"])
+	}
+
+	return invitationId, err
+}
+
+func parseInvitation(r *http.Request) (PlotInvitation, error) {
+	decoder := json.NewDecoder(r.Body)
+	var invitation PlotInvitation
+	err := decoder.Decode(&invitation)
+	if err != nil {
+		return PlotInvitation{}, err
+	}
+	defer r.Body.Close()
+
+	invitation.Email = strings.TrimSpace(invitation.Email)
+	if !strings.Contains(invitation.Email, "@") {
+		return PlotInvitation{}, errors.New("Invalid invitation: email must be specified.")
+	}
+
+	if invitation.Role == NoRole {
+		return PlotInvitation{}, errors.New("Invalid invitation: role must be specified.")
+	}
+
+	return invitation, nil
+}
+
+func parseMemberRole(r *http.Request) (Role, error) {
+	decoder := json.NewDecoder(r.Body)
+	var request MemberRoleRequest
+	err := decoder.Decode(&request)
+	if err != nil {
+		return NoRole, err
+	}
+	defer r.Body.Close()
+
+	if request.Role == NoRole {
+		return NoRole, errors.New("Role must be specified")
+	}
+	return request.Role, nil
+}
+
+func (env *Env) getPlotMembers(w http.ResponseWriter, r *http.Request) {
+	_, plotId, ok := env.checkPlotAccess(w, r, Viewer)
+	if !ok {
+		return
+	}
+
+	members, err := env.db.getPlotMembers(plotId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, _ := json.Marshal(members)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+func (env *Env) updatePlotMember(w http.ResponseWriter, r *http.Request) {
+	user, plotId, ok := env.checkPlotAccess(w, r, Owner)
+	if !ok {
+		return
+	}
+
+	role, err := parseMemberRole(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	memberId := mux.Vars(r)["memberId"]
+	updated, err := env.db.setPlotMemberRole(plotId, memberId, role)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !updated {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"id":        user,
+		"plot-id":   plotId,
+		"member-id": memberId,
+		"role":      role,
+	}).Info("Changed role of plot member")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Owners can remove anyone but the creator of the plot, and members can
+// always leave a plot.
+func (env *Env) removePlotMember(w http.ResponseWriter, r *http.Request) {
+	user, err := getUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	plotId, err := getPlotId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	memberId := mux.Vars(r)["memberId"]
+	if memberId != user {
+		allowed, err := checkPlotPermission(user, plotId, Owner, env.db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !allowed {
+			http.Error(w, "User is not allowed to change plot",
+				http.StatusForbidden)
+			return
+		}
+	}
+
+	removed, err := env.db.removePlotMember(plotId, memberId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !removed {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (env *Env) getPlotInvitations(w http.ResponseWriter, r *http.Request) {
+	_, plotId, ok := env.checkPlotAccess(w, r, Owner)
+	if !ok {
+		return
+	}
+
+	invitations, err := env.db.getPlotInvitations(plotId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, _ := json.Marshal(invitations)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+func (env *Env) addPlotInvitation(w http.ResponseWriter, r *http.Request) {
+	user, plotId, ok := env.checkPlotAccess(w, r, Owner)
+	if !ok {
+		return
+	}
+
+	invitation, err := parseInvitation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	invitation.PlotId = plotId
+	invitation.InvitedBy = user
+	invitation, err = env.db.addPlotInvitation(invitation)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"id":      user,
+		"plot-id": plotId,
+		"email":   invitation.Email,
+		"role":    invitation.Role,
+	}).Info("Invited user to plot")
+
+	jsonData, _ := json.Marshal(invitation)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonData)
+}
+
+func (env *Env) removePlotInvitation(w http.ResponseWriter, r *http.Request) {
+	_, plotId, ok := env.checkPlotAccess(w, r, Owner)
+	if !ok {
+		return
+	}
+
+	invitationId, err := getInvitationId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	removed, err := env.db.removePlotInvitation(plotId, invitationId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !removed {
+		http.Error(w, "Invitation not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Invitations are matched on verified emails only. Users without one, such
+// as local accounts, are told so instead of never finding an invitation.
+func (env *Env) checkEmailVerified(w http.ResponseWriter, user string) bool {
+	verified, err := env.db.isEmailVerified(user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	if !verified {
+		http.Error(w, "Invitations can only be accepted with an email verified by the token issuer",
+			http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (env *Env) getUserInvitations(w http.ResponseWriter, r *http.Request) {
+	user, err := getUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !env.checkEmailVerified(w, user) {
+		return
+	}
+
+	invitations, err := env.db.getInvitationsForUser(user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, _ := json.Marshal(invitations)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+func (env *Env) acceptInvitation(w http.ResponseWriter, r *http.Request) {
+	user, err := getUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	invitationId, err := getInvitationId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !env.checkEmailVerified(w, user) {
+		return
+	}
+
+	invitation, err := env.db.acceptInvitation(invitationId, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if invitation == nil {
+		http.Error(w, "Invitation not found", http.StatusNotFound)
+		return
+	}
+
+	jsonData, _ := json.Marshal(invitation)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestPlotAccessRole(t *testing.T) {
+	alice, bob := "alice", "bob"
+	organizationId := 1
+	viewer, editor, owner := Viewer, Editor, Owner
+
+	tests := []struct {
+		name   string
+		access PlotAccess
+		user   string
+		role   Role
+	}{
+		{"owner of personal plot", PlotAccess{Login: &alice}, alice, Owner},
+		{"stranger to personal plot", PlotAccess{Login: &alice}, bob, NoRole},
+		{"plot member", PlotAccess{Login: &alice, MemberRole: &editor}, bob, Editor},
+		{"organization member", PlotAccess{OrganizationId: &organizationId, OrganizationRole: &viewer}, alice, Viewer},
+		{"organization owner", PlotAccess{OrganizationId: &organizationId, OrganizationRole: &owner}, alice, Owner},
+		{"highest role", PlotAccess{OrganizationId: &organizationId, MemberRole: &editor, OrganizationRole: &viewer}, alice, Editor},
+		{"creator removed from organization", PlotAccess{OrganizationId: &organizationId}, alice, NoRole},
+		{"creator of organization plot with login", PlotAccess{Login: &alice, OrganizationId: &organizationId}, alice, NoRole},
+		{"organization editor creating a plot", PlotAccess{Login: &alice, OrganizationId: &organizationId, OrganizationRole: &editor}, alice, Editor},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if role := test.access.role(test.user); role != test.role {
+				t.Errorf("expected %v, got %v", test.role, role)
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func getOrganizationId(r *http.Request) (int, error) {
+	vars := mux.Vars(r)
+	organizationId, err := strconv.Atoi(vars["organizationId"])
+	if err != nil {
+		return organizationId, errors.New("Invalid organization id: " + vars["organizationId"])
+	}
+
+	return organizationId, err
+}
+
+// Get the user and organization id from the request and verify that the user
+// has at least the required role in the organization, writing an error
+// response if not.
+func (env *Env) checkOrganizationAccess(w http.ResponseWriter, r *http.Request, required Role) (string, int, bool) {
+	user, err := getUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return "", 0, false
+	}
+
+	organizationId, err := getOrganizationId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", 0, false
+	}
+
+	role, err := env.db.getOrganizationRole(user, organizationId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return "", 0, false
+	}
+
+	if role < required {
+		http.Error(w, "User is not allowed to access organization",
+			http.StatusForbidden)
+		return "", 0, false
+	}
+
+	return user, organizationId, true
+}
+
+func parseOrganization(r *http.Request) (Organization, error) {
+	decoder := json.NewDecoder(r.Body)
+	var organization Organization
+	err := decoder.Decode(&organization)
+	if err != nil {
+		return Organization{}, err
+	}
+	defer r.Body.Close()
+
+	organization.Name = strings.TrimSpace(organization.Name)
+	if organization.Name == "" {
+		return Organization{}, errors.New("Invalid organization: name must be specified.")
+	}
+
+	return Organization{Name: organization.Name}, nil
+}
+
+func parseOrganizationMember(r *http.Request) (OrganizationMemberRequest, error) {
+	decoder := json.NewDecoder(r.Body)
+	var request OrganizationMemberRequest
+	err := decoder.Decode(&request)
+	if err != nil {
+		return OrganizationMemberRequest{}, err
+	}
+	defer r.Body.Close()
+
+	request.Email = strings.TrimSpace(request.Email)
+	if request.Email == "" {
+		return OrganizationMemberRequest{}, errors.New("Email must be specified")
+	}
+	if request.Role == NoRole {
+		return OrganizationMemberRequest{}, errors.New("Role must be specified")
+	}
+	return request, nil
+}
+
+func (env *Env) getOrganizations(w http.ResponseWriter, r *http.Request) {
+	user, err := getUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	organizations, err := env.db.getOrganizations(user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, _ := json.Marshal(organizations)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+func (env *Env) addOrganization(w http.ResponseWriter, r *http.Request) {
+	user, err := getUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	organization, err := parseOrganization(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	organization, err = env.db.createOrganization(organization, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, _ := json.Marshal(organization)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonData)
+}
+
+func (env *Env) getOrganizationMembers(w http.ResponseWriter, r *http.Request) {
+	_, organizationId, ok := env.checkOrganizationAccess(w, r, Viewer)
+	if !ok {
+		return
+	}
+
+	members, err := env.db.getOrganizationMembers(organizationId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, _ := json.Marshal(members)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+func (env *Env) addOrganizationMember(w http.ResponseWriter, r *http.Request) {
+	user, organizationId, ok := env.checkOrganizationAccess(w, r, Owner)
+	if !ok {
+		return
+	}
+
+	request, err := parseOrganizationMember(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	added, err := env.db.setOrganizationMember(organizationId, request.Email, request.Role)
+	if err == ErrEmailNotVerified {
+		http.Error(w, "The user with email "+request.Email+" has not verified it, so can not be added",
+			http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !added {
+		http.Error(w, "No user found with email "+request.Email, http.StatusNotFound)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"id":              user,
+		"organization-id": organizationId,
+		"email":           request.Email,
+		"role":            request.Role,
+	}).Info("Added organization member")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (env *Env) updateOrganizationMember(w http.ResponseWriter, r *http.Request) {
+	_, organizationId, ok := env.checkOrganizationAccess(w, r, Owner)
+	if !ok {
+		return
+	}
+
+	role, err := parseMemberRole(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	updated, err := env.db.setOrganizationMemberRole(organizationId, mux.Vars(r)["memberId"], role)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !updated {
+		http.Error(w, "Member not found or last owner", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Owners can remove anyone, and members can always leave, as long as an
+// owner remains.
+func (env *Env) removeOrganizationMember(w http.ResponseWriter, r *http.Request) {
+	user, organizationId, ok := env.checkOrganizationAccess(w, r, Viewer)
+	if !ok {
+		return
+	}
+
+	memberId := mux.Vars(r)["memberId"]
+	if memberId != user {
+		role, err := env.db.getOrganizationRole(user, organizationId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if role < Owner {
+			http.Error(w, "User is not allowed to change organization",
+				http.StatusForbidden)
+			return
+		}
+	}
+
+	removed, err := env.db.removeOrganizationMember(organizationId, memberId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !removed {
+		http.Error(w, "Member not found or last owner", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (env *Env) getOrganizationApiKeys(w http.ResponseWriter, r *http.Request) {
+	_, organizationId, ok := env.checkOrganizationAccess(w, r, Owner)
+	if !ok {
+		return
+	}
+
+	apiKeys, err := env.db.getOrganizationApiKeys(organizationId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, _ := json.Marshal(apiKeys)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+func (env *Env) addOrganizationApiKey(w http.ResponseWriter, r *http.Request) {
+	user, organizationId, ok := env.checkOrganizationAccess(w, r, Owner)
+	if !ok {
+		return
+	}
+
+	env.createApiKeyAndWriteResponse(w, r, user, &organizationId)
+}
+
+func (env *Env) removeOrganizationApiKey(w http.ResponseWriter, r *http.Request) {
+	_, organizationId, ok := env.checkOrganizationAccess(w, r, Owner)
+	if !ok {
+		return
+	}
+
+	keyId, err := getApiKeyId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	removed, err := env.db.removeOrganizationApiKey(organizationId, keyId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !removed {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const (
+	defaultOutlierWindow    = 11
+	defaultOutlierThreshold = 5.0
+	maxOutlierWindow        = 101
+	// Deviations below this fraction of the median are never outliers, so
+	// that small changes do not stand out when a sensor sends the same
+	// value for a while.
+	outlierMinDeviation = 0.05
+	// Nor are deviations within the noise of a sensor, which matters for
+	// series near zero, such as temperatures around freezing.
+	minTemperatureDeviationC = 0.5
+	minGravityDeviationSG    = 0.002
+	// Scales the median absolute deviation to a standard deviation
+	madScale = 1.4826
+)
+
+type OutlierReport struct {
+	Flagged int `json:"flagged"`
+}
+
+type ExclusionReport struct {
+	Updated int64 `json:"updated"`
+}
+
+// The smallest deviation from the median that can be an outlier for a type
+// of instrument, in the units of the plot.
+func minInstrumentDeviation(kind string, plot Plot) float64 {
+	switch kind {
+	case "temperature":
+		if plot.TemperatureUnit == "F" {
+			return minTemperatureDeviationC * 9 / 5
+		}
+		return minTemperatureDeviationC
+	case "gravity":
+		if plot.GravityUnit == "points" {
+			return minGravityDeviationSG * 1000
+		}
+		return minGravityDeviationSG
+	}
+	return 0
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+// Find readings that deviate from the rolling median of the readings
+// around them by more than threshold times the median absolute deviation,
+// and by at least the minimum deviation of their key. Readings are ordered
+// by key and time. Readings excluded by hand are ignored, and readings kept
+// by hand are never flagged.
+func findOutliers(readings []Reading, window int, threshold float64, minDeviation map[string]float64) []int64 {
+	outliers := []int64{}
+	for start := 0; start < len(readings); {
+		end := start
+		series := []Reading{}
+		for ; end < len(readings) && readings[end].Key == readings[start].Key; end++ {
+			reason := readings[end].ExclusionReason
+			if reason == nil || *reason != "manual" {
+				series = append(series, readings[end])
+			}
+		}
+		key := readings[start].Key
+		start = end
+
+		if len(series) < 3 {
+			continue
+		}
+
+		size := window
+		if size > len(series) {
+			size = len(series)
+		}
+		values := make([]float64, len(series))
+		for i, reading := range series {
+			values[i] = reading.Value
+		}
+
+		for i, reading := range series {
+			if reading.ExclusionReason != nil && *reading.ExclusionReason == "kept" {
+				continue
+			}
+
+			// Center the window on the reading, shifting it at the ends
+			from := i - size/2
+			if from < 0 {
+				from = 0
+			}
+			if from+size > len(values) {
+				from = len(values) - size
+			}
+			neighbours := values[from : from+size]
+
+			m := median(neighbours)
+			deviations := make([]float64, len(neighbours))
+			for j, value := range neighbours {
+				deviations[j] = math.Abs(value - m)
+			}
+			limit := math.Max(threshold*madScale*median(deviations), outlierMinDeviation*math.Abs(m))
+			limit = math.Max(limit, minDeviation[key])
+			if math.Abs(reading.Value-m) > limit {
+				outliers = append(outliers, reading.Id)
+			}
+		}
+	}
+	return outliers
+}
+
+func parseOutlierOptions(r *http.Request) (int, float64, error) {
+	window := defaultOutlierWindow
+	if val := r.URL.Query().Get("window"); val != "" {
+		parsed, err := strconv.Atoi(val)
+		if err != nil || parsed < 3 || parsed > maxOutlierWindow {
+			return 0, 0, errors.New("Invalid window: must be between 3 and 101 readings")
+		}
+		window = parsed
+	}
+
+	threshold := defaultOutlierThreshold
+	if val := r.URL.Query().Get("threshold"); val != "" {
+		parsed, err := strconv.ParseFloat(val, 64)
+		if err != nil || parsed <= 0 {
+			return 0, 0, errors.New("Invalid threshold: " + val)
+		}
+		threshold = parsed
+	}
+	return window, threshold, nil
+}
+
+// Flag the outliers of a plot, replacing earlier flags.
+func (env *Env) detectOutliers(w http.ResponseWriter, r *http.Request) {
+	user, plotId, ok := env.checkPlotAccess(w, r, Editor)
+	if !ok {
+		return
+	}
+
+	window, threshold, err := parseOutlierOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	plot, err := env.db.getPlot(plotId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	instruments, err := env.db.getInstruments(plotId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	minDeviation := map[string]float64{}
+	for _, instrument := range instruments {
+		minDeviation[instrument.Key] = minInstrumentDeviation(instrument.Type, plot)
+	}
+
+	readings, err := env.db.readPlotReadings(plotId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	outliers := findOutliers(readings, window, threshold, minDeviation)
+	err = env.db.flagOutliers(plotId, outliers)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"id":       user,
+		"plot-id":  plotId,
+		"readings": len(readings),
+		"outliers": len(outliers),
+	}).Info("Flagged outliers")
+
+	jsonData, _ := json.Marshal(OutlierReport{Flagged: len(outliers)})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+func parseReadingRefs(r *http.Request) ([]ReadingRef, error) {
+	decoder := json.NewDecoder(r.Body)
+	var readings []ReadingRef
+	err := decoder.Decode(&readings)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	if len(readings) == 0 {
+		return nil, errors.New("At least one reading must be specified")
+	}
+	for _, reading := range readings {
+		if reading.Key == "" || reading.Timestamp.IsZero() {
+			return nil, errors.New("Readings must have a key and a timestamp")
+		}
+	}
+	return readings, nil
+}
+
+func (env *Env) setReadingsExcluded(w http.ResponseWriter, r *http.Request, excluded bool) {
+	_, plotId, ok := env.checkPlotAccess(w, r, Editor)
+	if !ok {
+		return
+	}
+
+	readings, err := parseReadingRefs(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	updated, err := env.db.setReadingsExcluded(plotId, readings, excluded)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, _ := json.Marshal(ExclusionReport{Updated: updated})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+func (env *Env) excludeReadings(w http.ResponseWriter, r *http.Request) {
+	env.setReadingsExcluded(w, r, true)
+}
+
+func (env *Env) includeReadings(w http.ResponseWriter, r *http.Request) {
+	env.setReadingsExcluded(w, r, false)
+}
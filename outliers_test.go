@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testReadings(key string, values ...float64) []Reading {
+	readings := []Reading{}
+	for i, value := range values {
+		readings = append(readings, Reading{Id: int64(i + 1), Key: key, Value: value})
+	}
+	return readings
+}
+
+func TestFindOutliers(t *testing.T) {
+	manual, kept := "manual", "kept"
+
+	tests := []struct {
+		name         string
+		readings     []Reading
+		minDeviation float64
+		outliers     []int64
+	}{
+		{"flat series", testReadings("temp", 20, 20, 20, 20, 20, 20, 20), 0, []int64{}},
+		{"spike in flat series", testReadings("temp", 20, 20, 20, 35, 20, 20, 20), 0, []int64{4}},
+		{"noisy series", testReadings("temp", 20, 20.2, 19.9, 20.1, 20, 19.8, 20.1), 0, []int64{}},
+		{"first reading", testReadings("temp", 35, 20, 20, 20, 20, 20, 20), 0, []int64{1}},
+		{"too few readings", testReadings("temp", 20, 35), 0, []int64{}},
+		// The relative minimum deviation is zero around zero, so without a
+		// minimum for the instrument any change stands out
+		{"change near zero", testReadings("temp", 0, 0, 0, 0.1, 0, 0, 0), 0, []int64{4}},
+		{"noise near zero", testReadings("temp", 0, 0, 0, 0.1, 0, 0, 0), 0.5, []int64{}},
+		{"spike near zero", testReadings("temp", 0, 0.1, 0, 8, 0, -0.1, 0), 0.5, []int64{4}},
+		{"gravity", testReadings("grav", 1.050, 1.050, 1.049, 1.2, 1.049, 1.048, 1.048), 0.002, []int64{4}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			minDeviation := map[string]float64{"temp": test.minDeviation, "grav": test.minDeviation}
+			outliers := findOutliers(test.readings, 5, defaultOutlierThreshold, minDeviation)
+			if !reflect.DeepEqual(outliers, test.outliers) {
+				t.Errorf("expected %v, got %v", test.outliers, outliers)
+			}
+		})
+	}
+
+	t.Run("readings set by hand", func(t *testing.T) {
+		readings := testReadings("temp", 20, 20, 35, 20, 20, 50, 20, 20)
+		readings[2].ExclusionReason = &kept
+		readings[5].ExclusionReason = &manual
+		outliers := findOutliers(readings, 5, defaultOutlierThreshold, map[string]float64{})
+		if len(outliers) != 0 {
+			t.Errorf("expected no outliers, got %v", outliers)
+		}
+	})
+
+	t.Run("series per key", func(t *testing.T) {
+		readings := append(testReadings("a", 20, 20, 20, 20), testReadings("b", 1, 1, 9, 1)...)
+		outliers := findOutliers(readings, 5, defaultOutlierThreshold, map[string]float64{})
+		if !reflect.DeepEqual(outliers, []int64{3}) {
+			t.Errorf("expected [3], got %v", outliers)
+		}
+	})
+}
+
+func TestMinInstrumentDeviation(t *testing.T) {
+	tests := []struct {
+		kind      string
+		plot      Plot
+		deviation float64
+	}{
+		{"temperature", Plot{TemperatureUnit: "C"}, 0.5},
+		{"temperature", Plot{TemperatureUnit: "F"}, 0.9},
+		{"gravity", Plot{GravityUnit: "sg"}, 0.002},
+		{"gravity", Plot{GravityUnit: "points"}, 2},
+		{"", Plot{}, 0},
+	}
+
+	for _, test := range tests {
+		if deviation := minInstrumentDeviation(test.kind, test.plot); deviation != test.deviation {
+			t.Errorf("%s in %+v: expected %v, got %v", test.kind, test.plot, test.deviation, deviation)
+		}
+	}
+}
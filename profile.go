@@ -0,0 +1,239 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	targetSeriesKey     = "target"
+	maxProfileSteps     = 50
+	maxProfileStepHours = 24 * 365
+)
+
+func hours(value float64) time.Duration {
+	return time.Duration(value * float64(time.Hour))
+}
+
+func interpolate(from float64, to float64, start time.Time, end time.Time, at time.Time) float64 {
+	if !end.After(start) {
+		return to
+	}
+	fraction := float64(at.Sub(start)) / float64(end.Sub(start))
+	return from + (to-from)*fraction
+}
+
+// The setpoint of a temperature profile that starts at startTime. Before
+// the start the first step is used, and after the last step its final
+// temperature is held. Returns nil for a plot without a profile.
+func profileSetpoint(startTime time.Time, steps []FermentationStep, at time.Time) *Setpoint {
+	if len(steps) == 0 {
+		return nil
+	}
+	if at.Before(startTime) {
+		at = startTime
+	}
+
+	previous := steps[0].Temperature
+	stepStart := startTime
+	for i, step := range steps {
+		rampEnd := stepStart.Add(hours(step.RampHours))
+		stepEnd := rampEnd.Add(hours(step.Days * 24))
+		final := step.Temperature
+		if step.EndTemperature != nil {
+			final = *step.EndTemperature
+		}
+
+		if at.Before(stepEnd) {
+			setpoint := &Setpoint{Step: i, StepName: step.Name}
+			switch {
+			case at.Before(rampEnd):
+				setpoint.Target = interpolate(previous, step.Temperature, stepStart, rampEnd, at)
+				setpoint.Ramping = true
+				setpoint.NextChange = &rampEnd
+				setpoint.NextTarget = &step.Temperature
+			case step.EndTemperature != nil:
+				setpoint.Target = interpolate(step.Temperature, final, rampEnd, stepEnd, at)
+				setpoint.Ramping = true
+				setpoint.NextChange = &stepEnd
+				setpoint.NextTarget = &final
+			default:
+				setpoint.Target = step.Temperature
+				if i+1 < len(steps) {
+					setpoint.NextChange = &stepEnd
+					setpoint.NextTarget = &steps[i+1].Temperature
+				}
+			}
+			return setpoint
+		}
+
+		previous = final
+		stepStart = stepEnd
+	}
+
+	last := len(steps) - 1
+	return &Setpoint{Step: last, StepName: steps[last].Name, Target: previous}
+}
+
+// Add the target temperature of the profile to the plot data, unless an
+// instrument already uses the key of the target series.
+func addTargetSeries(db *Database, plotId int, plots []PlotData) error {
+	if len(plots) == 0 {
+		return nil
+	}
+
+	steps, err := db.getFermentationSteps(plotId)
+	if err != nil || len(steps) == 0 {
+		return err
+	}
+
+	plot, err := db.getPlot(plotId)
+	if err != nil {
+		return err
+	}
+
+	for _, data := range plots {
+		if _, found := data.Values[targetSeriesKey]; found {
+			continue
+		}
+		setpoint := profileSetpoint(plot.StartTime, steps, data.Date)
+		data.Values[targetSeriesKey] = setpoint.Target
+	}
+	return nil
+}
+
+func parseProfile(r *http.Request) ([]FermentationStep, error) {
+	decoder := json.NewDecoder(r.Body)
+	var steps []FermentationStep
+	err := decoder.Decode(&steps)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	report := ValidationReport{Message: "Invalid profile"}
+	if len(steps) > maxProfileSteps {
+		report.add("steps", "must be at most 50")
+	}
+	for i, step := range steps {
+		field := fmt.Sprintf("[%d].", i)
+		steps[i].Name = strings.TrimSpace(step.Name)
+		if len(steps[i].Name) > 255 {
+			report.add(field+"name", "must be at most 255 characters")
+		}
+		if step.Temperature < -20 || step.Temperature > 120 {
+			report.add(field+"temperature", "must be between -20 and 120")
+		}
+		if step.EndTemperature != nil && (*step.EndTemperature < -20 || *step.EndTemperature > 120) {
+			report.add(field+"endTemperature", "must be between -20 and 120")
+		}
+		if step.RampHours < 0 || step.RampHours > maxProfileStepHours {
+			report.add(field+"rampHours", "must be between 0 and 8760")
+		}
+		if step.Days < 0 || step.Days*24 > maxProfileStepHours {
+			report.add(field+"days", "must be between 0 and 365")
+		}
+	}
+
+	if len(report.Problems) > 0 {
+		return nil, &report
+	}
+	if steps == nil {
+		steps = []FermentationStep{}
+	}
+	return steps, nil
+}
+
+func (env *Env) getProfile(w http.ResponseWriter, r *http.Request) {
+	_, plotId, ok := env.checkPlotAccess(w, r, Viewer)
+	if !ok {
+		return
+	}
+
+	steps, err := env.db.getFermentationSteps(plotId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, _ := json.Marshal(steps)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+// Replace the temperature profile. An empty list removes it.
+func (env *Env) updateProfile(w http.ResponseWriter, r *http.Request) {
+	user, plotId, ok := env.checkPlotAccess(w, r, Editor)
+	if !ok {
+		return
+	}
+
+	steps, err := parseProfile(r)
+	if err != nil {
+		writeRequestError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	err = env.db.setFermentationSteps(plotId, steps)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"id":      user,
+		"plot-id": plotId,
+		"steps":   len(steps),
+	}).Info("Updated temperature profile")
+
+	jsonData, _ := json.Marshal(steps)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+// Controllers authenticate with an ingest key that may read the plot.
+func (env *Env) getSetpoint(w http.ResponseWriter, r *http.Request) {
+	plotId, ok := env.checkIfKeyCanReadPlot(w, r)
+	if !ok {
+		return
+	}
+
+	plot, err := env.db.getPlot(plotId)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Plot not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	steps, err := env.db.getFermentationSteps(plotId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !plot.Active {
+		http.Error(w, "Plot has ended", http.StatusGone)
+		return
+	}
+
+	setpoint := profileSetpoint(plot.StartTime, steps, time.Now().UTC())
+	if setpoint == nil {
+		http.Error(w, "Plot has no temperature profile", http.StatusNotFound)
+		return
+	}
+	setpoint.PlotId = plotId
+	setpoint.Unit = plot.TemperatureUnit
+
+	jsonData, _ := json.Marshal(setpoint)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(jsonData)
+}
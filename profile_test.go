@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestProfileSetpoint(t *testing.T) {
+	start := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(h float64) time.Time { return start.Add(hours(h)) }
+	end := 2.0
+	steps := []FermentationStep{
+		{Name: "primary", Temperature: 18, Days: 2},
+		{Name: "rest", Temperature: 21, RampHours: 12, Days: 2},
+		{Name: "crash", Temperature: 4, EndTemperature: &end, Days: 1},
+	}
+
+	tests := []struct {
+		name       string
+		hours      float64
+		step       int
+		target     float64
+		ramping    bool
+		nextChange float64
+		nextTarget float64
+	}{
+		{"before start", -10, 0, 18, false, 48, 21},
+		{"start", 0, 0, 18, false, 48, 21},
+		{"ramp start", 48, 1, 18, true, 60, 21},
+		{"halfway ramp", 54, 1, 19.5, true, 60, 21},
+		{"ramp end", 60, 1, 21, false, 108, 4},
+		{"end temperature start", 108, 2, 4, true, 132, 2},
+		{"halfway end temperature", 120, 2, 3, true, 132, 2},
+		{"last step end", 132, 2, 2, false, 0, 0},
+		{"after last step", 1000, 2, 2, false, 0, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setpoint := profileSetpoint(start, steps, at(test.hours))
+			if setpoint.Step != test.step || setpoint.StepName != steps[test.step].Name {
+				t.Errorf("expected step %d, got %d (%s)", test.step, setpoint.Step, setpoint.StepName)
+			}
+			if math.Abs(setpoint.Target-test.target) > 1e-9 {
+				t.Errorf("expected target %v, got %v", test.target, setpoint.Target)
+			}
+			if setpoint.Ramping != test.ramping {
+				t.Errorf("expected ramping %v, got %v", test.ramping, setpoint.Ramping)
+			}
+
+			if test.nextChange == 0 {
+				if setpoint.NextChange != nil || setpoint.NextTarget != nil {
+					t.Errorf("expected no next change, got %v", setpoint.NextChange)
+				}
+				return
+			}
+			if setpoint.NextChange == nil || !setpoint.NextChange.Equal(at(test.nextChange)) {
+				t.Errorf("expected next change at %v, got %v", at(test.nextChange), setpoint.NextChange)
+			}
+			if setpoint.NextTarget == nil || *setpoint.NextTarget != test.nextTarget {
+				t.Errorf("expected next target %v, got %v", test.nextTarget, setpoint.NextTarget)
+			}
+		})
+	}
+
+	if setpoint := profileSetpoint(start, nil, start); setpoint != nil {
+		t.Errorf("expected no setpoint without a profile, got %+v", setpoint)
+	}
+}
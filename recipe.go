@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const maxRecipeSize = 1 << 20
+
+// What a plot can show of a BeerXML or BeerJSON recipe, with gravity in sg
+// and temperatures in Celsius. Nil or empty fields were not in the file,
+// and everything in the file that could not be imported is listed in
+// Unsupported.
+type Recipe struct {
+	Name        string
+	Style       string
+	BatchSize   *float64
+	Yeast       string
+	OG          *float64
+	FG          *float64
+	Steps       []FermentationStep
+	Unsupported []string
+}
+
+type beerXMLRecipe struct {
+	Name  string `xml:"NAME"`
+	Style struct {
+		Name string `xml:"NAME"`
+	} `xml:"STYLE"`
+	BatchSize *float64 `xml:"BATCH_SIZE"`
+	OG        *float64 `xml:"OG"`
+	FG        *float64 `xml:"FG"`
+	Yeasts    []struct {
+		Name string `xml:"NAME"`
+	} `xml:"YEASTS>YEAST"`
+	Stages        *int       `xml:"FERMENTATION_STAGES"`
+	PrimaryAge    *float64   `xml:"PRIMARY_AGE"`
+	PrimaryTemp   *float64   `xml:"PRIMARY_TEMP"`
+	SecondaryAge  *float64   `xml:"SECONDARY_AGE"`
+	SecondaryTemp *float64   `xml:"SECONDARY_TEMP"`
+	TertiaryAge   *float64   `xml:"TERTIARY_AGE"`
+	TertiaryTemp  *float64   `xml:"TERTIARY_TEMP"`
+	Age           *float64   `xml:"AGE"`
+	AgeTemp       *float64   `xml:"AGE_TEMP"`
+	Hops          []struct{} `xml:"HOPS>HOP"`
+	Fermentables  []struct{} `xml:"FERMENTABLES>FERMENTABLE"`
+	Miscs         []struct{} `xml:"MISCS>MISC"`
+	Waters        []struct{} `xml:"WATERS>WATER"`
+	Mash          *struct{}  `xml:"MASH"`
+}
+
+type beerXMLDocument struct {
+	Recipes []beerXMLRecipe `xml:"RECIPE"`
+}
+
+type beerJSONValue struct {
+	Unit  string  `json:"unit"`
+	Value float64 `json:"value"`
+}
+
+type beerJSONStep struct {
+	Name             string         `json:"name"`
+	StartTemperature *beerJSONValue `json:"start_temperature"`
+	EndTemperature   *beerJSONValue `json:"end_temperature"`
+	StepTime         *beerJSONValue `json:"step_time"`
+}
+
+type beerJSONRecipe struct {
+	Name  string `json:"name"`
+	Style *struct {
+		Name string `json:"name"`
+	} `json:"style"`
+	BatchSize       *beerJSONValue `json:"batch_size"`
+	OriginalGravity *beerJSONValue `json:"original_gravity"`
+	FinalGravity    *beerJSONValue `json:"final_gravity"`
+	Ingredients     struct {
+		Cultures []struct {
+			Name string `json:"name"`
+		} `json:"culture_additions"`
+		Fermentables []json.RawMessage `json:"fermentable_additions"`
+		Hops         []json.RawMessage `json:"hop_additions"`
+		Miscs        []json.RawMessage `json:"miscellaneous_additions"`
+		Waters       []json.RawMessage `json:"water_additions"`
+	} `json:"ingredients"`
+	Fermentation *struct {
+		Steps []beerJSONStep `json:"fermentation_steps"`
+	} `json:"fermentation"`
+	Mash *json.RawMessage `json:"mash"`
+}
+
+type beerJSONDocument struct {
+	BeerJSON struct {
+		Recipes []beerJSONRecipe `json:"recipes"`
+	} `json:"beerjson"`
+}
+
+// Ingredients are listed as unsupported rather than silently dropped.
+func unsupportedIngredients(counts map[string]int) []string {
+	unsupported := []string{}
+	for _, name := range []string{"fermentables", "hops", "miscs", "waters", "mash"} {
+		if counts[name] > 0 {
+			unsupported = append(unsupported, name)
+		}
+	}
+	return unsupported
+}
+
+func parseBeerXML(data []byte) (Recipe, error) {
+	var document beerXMLDocument
+	err := xml.Unmarshal(data, &document)
+	if err != nil {
+		return Recipe{}, errors.New("Invalid BeerXML: " + err.Error())
+	}
+
+	// Some programs export a single RECIPE without RECIPES around it
+	if len(document.Recipes) == 0 {
+		var single beerXMLRecipe
+		err = xml.Unmarshal(data, &single)
+		if err != nil || single.Name == "" {
+			return Recipe{}, errors.New("Invalid BeerXML: no recipe found")
+		}
+		document.Recipes = append(document.Recipes, single)
+	}
+
+	source := document.Recipes[0]
+	recipe := Recipe{
+		Name:      strings.TrimSpace(source.Name),
+		Style:     strings.TrimSpace(source.Style.Name),
+		BatchSize: source.BatchSize,
+		OG:        source.OG,
+		FG:        source.FG,
+	}
+	for i := 1; i < len(document.Recipes); i++ {
+		recipe.Unsupported = append(recipe.Unsupported, fmt.Sprintf("recipes[%d]", i))
+	}
+
+	if len(source.Yeasts) > 0 {
+		recipe.Yeast = strings.TrimSpace(source.Yeasts[0].Name)
+	}
+	for i := 1; i < len(source.Yeasts); i++ {
+		recipe.Unsupported = append(recipe.Unsupported, fmt.Sprintf("yeasts[%d]", i))
+	}
+
+	// BeerXML has fixed stages, in days and degrees Celsius
+	stages := []struct {
+		name  string
+		field string
+		temp  *float64
+		age   *float64
+	}{
+		{"Primary", "PRIMARY", source.PrimaryTemp, source.PrimaryAge},
+		{"Secondary", "SECONDARY", source.SecondaryTemp, source.SecondaryAge},
+		{"Tertiary", "TERTIARY", source.TertiaryTemp, source.TertiaryAge},
+	}
+	for i, stage := range stages {
+		switch {
+		case stage.temp == nil && stage.age == nil:
+		case source.Stages != nil && *source.Stages >= 0 && i >= *source.Stages:
+			recipe.Unsupported = append(recipe.Unsupported, stage.field+" stage beyond FERMENTATION_STAGES")
+		case stage.temp == nil:
+			recipe.Unsupported = append(recipe.Unsupported, stage.field+"_AGE without "+stage.field+"_TEMP")
+		default:
+			step := FermentationStep{Name: stage.name, Temperature: *stage.temp}
+			if stage.age != nil {
+				step.Days = *stage.age
+			}
+			recipe.Steps = append(recipe.Steps, step)
+		}
+	}
+	switch {
+	case source.AgeTemp == nil && source.Age == nil:
+	case source.AgeTemp == nil:
+		recipe.Unsupported = append(recipe.Unsupported, "AGE without AGE_TEMP")
+	case source.Age == nil || *source.Age <= 0:
+		recipe.Unsupported = append(recipe.Unsupported, "AGE_TEMP without AGE")
+	default:
+		recipe.Steps = append(recipe.Steps, FermentationStep{Name: "Aging", Temperature: *source.AgeTemp, Days: *source.Age})
+	}
+
+	mash := 0
+	if source.Mash != nil {
+		mash = 1
+	}
+	recipe.Unsupported = append(recipe.Unsupported, unsupportedIngredients(map[string]int{
+		"fermentables": len(source.Fermentables),
+		"hops":         len(source.Hops),
+		"miscs":        len(source.Miscs),
+		"waters":       len(source.Waters),
+		"mash":         mash,
+	})...)
+	return recipe, nil
+}
+
+func gravityToSG(value beerJSONValue) (float64, bool) {
+	switch strings.ToLower(value.Unit) {
+	case "sg":
+		return value.Value, true
+	case "plato", "brix":
+		plato := value.Value
+		return 1 + plato/(258.6-(plato/258.2)*227.1), true
+	}
+	return 0, false
+}
+
+func volumeToLiters(value beerJSONValue) (float64, bool) {
+	liters := map[string]float64{
+		"ml":  0.001,
+		"l":   1,
+		"qt":  0.946353,
+		"gal": 3.785412,
+		"bbl": 117.347765,
+	}
+	factor, found := liters[strings.ToLower(value.Unit)]
+	return value.Value * factor, found
+}
+
+func temperatureToCelsius(value beerJSONValue) (float64, bool) {
+	switch strings.ToUpper(value.Unit) {
+	case "C":
+		return value.Value, true
+	case "F":
+		return (value.Value - 32) * 5 / 9, true
+	}
+	return 0, false
+}
+
+func timeToDays(value beerJSONValue) (float64, bool) {
+	days := map[string]float64{
+		"sec":  1.0 / 86400,
+		"min":  1.0 / 1440,
+		"hr":   1.0 / 24,
+		"day":  1,
+		"week": 7,
+	}
+	factor, found := days[strings.ToLower(value.Unit)]
+	return value.Value * factor, found
+}
+
+func parseBeerJSON(data []byte) (Recipe, error) {
+	var document beerJSONDocument
+	err := json.Unmarshal(data, &document)
+	if err != nil {
+		return Recipe{}, errors.New("Invalid BeerJSON: " + err.Error())
+	}
+	if len(document.BeerJSON.Recipes) == 0 {
+		return Recipe{}, errors.New("Invalid BeerJSON: no recipe found")
+	}
+
+	source := document.BeerJSON.Recipes[0]
+	recipe := Recipe{Name: strings.TrimSpace(source.Name)}
+	for i := 1; i < len(document.BeerJSON.Recipes); i++ {
+		recipe.Unsupported = append(recipe.Unsupported, fmt.Sprintf("recipes[%d]", i))
+	}
+
+	unsupportedUnit := func(field string, value beerJSONValue) {
+		recipe.Unsupported = append(recipe.Unsupported, field+" in "+value.Unit)
+	}
+
+	if source.Style != nil {
+		recipe.Style = strings.TrimSpace(source.Style.Name)
+	}
+	if source.BatchSize != nil {
+		if liters, ok := volumeToLiters(*source.BatchSize); ok {
+			recipe.BatchSize = &liters
+		} else {
+			unsupportedUnit("batch_size", *source.BatchSize)
+		}
+	}
+	if source.OriginalGravity != nil {
+		if sg, ok := gravityToSG(*source.OriginalGravity); ok {
+			recipe.OG = &sg
+		} else {
+			unsupportedUnit("original_gravity", *source.OriginalGravity)
+		}
+	}
+	if source.FinalGravity != nil {
+		if sg, ok := gravityToSG(*source.FinalGravity); ok {
+			recipe.FG = &sg
+		} else {
+			unsupportedUnit("final_gravity", *source.FinalGravity)
+		}
+	}
+
+	cultures := source.Ingredients.Cultures
+	if len(cultures) > 0 {
+		recipe.Yeast = strings.TrimSpace(cultures[0].Name)
+	}
+	for i := 1; i < len(cultures); i++ {
+		recipe.Unsupported = append(recipe.Unsupported, fmt.Sprintf("culture_additions[%d]", i))
+	}
+
+	if source.Fermentation != nil {
+		for i, fermentationStep := range source.Fermentation.Steps {
+			field := fmt.Sprintf("fermentation_steps[%d]", i)
+			if fermentationStep.StartTemperature == nil {
+				recipe.Unsupported = append(recipe.Unsupported, field+" without start_temperature")
+				continue
+			}
+			temperature, ok := temperatureToCelsius(*fermentationStep.StartTemperature)
+			if !ok {
+				unsupportedUnit(field+".start_temperature", *fermentationStep.StartTemperature)
+				continue
+			}
+
+			step := FermentationStep{Name: strings.TrimSpace(fermentationStep.Name), Temperature: temperature}
+			if fermentationStep.EndTemperature != nil {
+				if endTemperature, ok := temperatureToCelsius(*fermentationStep.EndTemperature); ok {
+					step.EndTemperature = &endTemperature
+				} else {
+					unsupportedUnit(field+".end_temperature", *fermentationStep.EndTemperature)
+				}
+			}
+			if fermentationStep.StepTime != nil {
+				if days, ok := timeToDays(*fermentationStep.StepTime); ok {
+					step.Days = days
+				} else {
+					unsupportedUnit(field+".step_time", *fermentationStep.StepTime)
+				}
+			}
+			recipe.Steps = append(recipe.Steps, step)
+		}
+	}
+
+	mash := 0
+	if source.Mash != nil {
+		mash = 1
+	}
+	recipe.Unsupported = append(recipe.Unsupported, unsupportedIngredients(map[string]int{
+		"fermentables": len(source.Ingredients.Fermentables),
+		"hops":         len(source.Ingredients.Hops),
+		"miscs":        len(source.Ingredients.Miscs),
+		"waters":       len(source.Ingredients.Waters),
+		"mash":         mash,
+	})...)
+	return recipe, nil
+}
+
+// Recipes are detected by content type, or by their first character for
+// clients that upload them as plain text.
+func parseRecipe(r *http.Request) (Recipe, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRecipeSize+1))
+	if err != nil {
+		return Recipe{}, errors.New("Unable to read recipe: " + err.Error())
+	}
+	defer r.Body.Close()
+
+	if len(data) > maxRecipeSize {
+		return Recipe{}, errors.New("Recipe is too large")
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	data = bytes.TrimSpace(data)
+	switch {
+	case strings.Contains(contentType, "xml"):
+		return parseBeerXML(data)
+	case strings.Contains(contentType, "json"):
+		return parseBeerJSON(data)
+	case bytes.HasPrefix(data, []byte("<")):
+		return parseBeerXML(data)
+	case bytes.HasPrefix(data, []byte("{")):
+		return parseBeerJSON(data)
+	}
+	return Recipe{}, errors.New("Recipe must be BeerXML or BeerJSON")
+}
+
+func gravityInUnit(sg float64, unit string) float64 {
+	if unit == "points" {
+		return sg * 1000
+	}
+	return sg
+}
+
+func celsiusInUnit(celsius float64, unit string) float64 {
+	if unit == "F" {
+		return celsius*9/5 + 32
+	}
+	return celsius
+}
+
+// Set the batch metadata of the plot from the recipe, keeping what the
+// recipe does not have. Gravity and temperatures are converted to the
+// units of the plot, and the target temperatures span the fermentation
+// steps. Returns the names of the fields that were set.
+func (recipe Recipe) apply(plot *Plot) []string {
+	imported := []string{}
+	if recipe.Name != "" {
+		plot.Recipe = recipe.Name
+		imported = append(imported, "recipe")
+	}
+	if recipe.Style != "" {
+		plot.Style = recipe.Style
+		imported = append(imported, "style")
+	}
+	if recipe.BatchSize != nil {
+		plot.BatchSize = recipe.BatchSize
+		imported = append(imported, "batchSize")
+	}
+	if recipe.Yeast != "" {
+		plot.Yeast = recipe.Yeast
+		imported = append(imported, "yeast")
+	}
+	if recipe.OG != nil {
+		og := gravityInUnit(*recipe.OG, plot.GravityUnit)
+		plot.TargetOG = &og
+		imported = append(imported, "targetOg")
+	}
+	if recipe.FG != nil {
+		fg := gravityInUnit(*recipe.FG, plot.GravityUnit)
+		plot.TargetFG = &fg
+		imported = append(imported, "targetFg")
+	}
+
+	if len(recipe.Steps) > 0 {
+		steps := []FermentationStep{}
+		for _, step := range recipe.Steps {
+			step.Temperature = celsiusInUnit(step.Temperature, plot.TemperatureUnit)
+			if step.EndTemperature != nil {
+				endTemperature := celsiusInUnit(*step.EndTemperature, plot.TemperatureUnit)
+				step.EndTemperature = &endTemperature
+			}
+			steps = append(steps, step)
+		}
+
+		plot.FermentationSteps = steps
+		min, max := steps[0].Temperature, steps[0].Temperature
+		for _, step := range steps {
+			temperatures := []float64{step.Temperature}
+			if step.EndTemperature != nil {
+				temperatures = append(temperatures, *step.EndTemperature)
+			}
+			for _, temperature := range temperatures {
+				if temperature < min {
+					min = temperature
+				}
+				if temperature > max {
+					max = temperature
+				}
+			}
+		}
+		plot.TargetTempMin = &min
+		plot.TargetTempMax = &max
+		imported = append(imported, "fermentationSteps", "targetTempMin", "targetTempMax")
+	}
+	return imported
+}
+
+func (env *Env) importRecipe(w http.ResponseWriter, r *http.Request) {
+	user, plotId, ok := env.checkPlotAccess(w, r, Editor)
+	if !ok {
+		return
+	}
+
+	recipe, err := parseRecipe(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var imported []string
+	plot, err := env.db.saveRecipe(plotId, func(plot *Plot) error {
+		imported = recipe.apply(plot)
+
+		report := ValidationReport{Message: "Invalid recipe"}
+		validatePlotMetadata(plot, &report)
+		if len(report.Problems) > 0 {
+			return &report
+		}
+		return nil
+	})
+	if _, ok := err.(*ValidationReport); ok {
+		writeRequestError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"id":          user,
+		"plot-id":     plotId,
+		"imported":    len(imported),
+		"unsupported": len(recipe.Unsupported),
+	}).Info("Imported recipe")
+
+	unsupported := recipe.Unsupported
+	if unsupported == nil {
+		unsupported = []string{}
+	}
+	jsonData, _ := json.Marshal(RecipeImportReport{
+		Plot:        plot,
+		Imported:    imported,
+		Unsupported: unsupported,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+// Create a plot starting now from a recipe. The plot is named after the
+// recipe unless a name is given, and may belong to an organization.
+func (env *Env) addRecipePlot(w http.ResponseWriter, r *http.Request) {
+	user, err := getUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	organizationId, err := parseOrganizationFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !env.checkOrganizationPlot(w, user, organizationId) {
+		return
+	}
+
+	recipe, err := parseRecipe(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	plot := Plot{
+		Name:            strings.TrimSpace(query.Get("name")),
+		StartTime:       time.Now(),
+		OrganizationId:  organizationId,
+		GravityUnit:     query.Get("gravityUnit"),
+		TemperatureUnit: query.Get("temperatureUnit"),
+	}
+	if plot.Name == "" {
+		plot.Name = recipe.Name
+	}
+
+	imported := recipe.apply(&plot)
+	report := ValidationReport{Message: "Invalid recipe"}
+	validatePlotMetadata(&plot, &report)
+	if plot.Name == "" {
+		report.add("name", "must be specified when the recipe has no name")
+	} else if len(plot.Name) > 255 {
+		report.add("name", "must be at most 255 characters")
+	}
+	if len(report.Problems) > 0 {
+		writeRequestError(w, &report, http.StatusBadRequest)
+		return
+	}
+
+	plot, err = env.db.saveRecipePlot(plot, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"id":          user,
+		"plot-id":     plot.Id,
+		"imported":    len(imported),
+		"unsupported": len(recipe.Unsupported),
+	}).Info("Created plot from recipe")
+
+	unsupported := recipe.Unsupported
+	if unsupported == nil {
+		unsupported = []string{}
+	}
+	jsonData, _ := json.Marshal(RecipeImportReport{
+		Plot:        plot,
+		Imported:    imported,
+		Unsupported: unsupported,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonData)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func approximately(value *float64, expected float64) bool {
+	return value != nil && math.Abs(*value-expected) < 1e-4
+}
+
+func TestParseBeerJSON(t *testing.T) {
+	recipe, err := parseBeerJSON([]byte(`{"beerjson": {"recipes": [{
+		"name": "Helles",
+		"batch_size": {"unit": "gal", "value": 5},
+		"original_gravity": {"unit": "plato", "value": 12},
+		"final_gravity": {"unit": "kg", "value": 1},
+		"fermentation": {"fermentation_steps": [
+			{"name": "Primary", "start_temperature": {"unit": "F", "value": 50}, "end_temperature": {"unit": "F", "value": 59}, "step_time": {"unit": "week", "value": 2}},
+			{"name": "Crash", "start_temperature": {"unit": "C", "value": 1}, "step_time": {"unit": "hr", "value": 36}},
+			{"name": "Lager", "start_temperature": {"unit": "K", "value": 274}}
+		]}
+	}]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !approximately(recipe.BatchSize, 18.92706) {
+		t.Errorf("expected 5 gal in liters, got %v", recipe.BatchSize)
+	}
+	if !approximately(recipe.OG, 1.04838) {
+		t.Errorf("expected 12 plato in sg, got %v", recipe.OG)
+	}
+	if recipe.FG != nil {
+		t.Errorf("expected no final gravity in an unknown unit, got %v", *recipe.FG)
+	}
+
+	if len(recipe.Steps) != 2 {
+		t.Fatalf("expected 2 steps, got %+v", recipe.Steps)
+	}
+	primary, crash := recipe.Steps[0], recipe.Steps[1]
+	if !approximately(&primary.Temperature, 10) || !approximately(primary.EndTemperature, 15) || primary.Days != 14 {
+		t.Errorf("expected 10 to 15 °C for 14 days, got %+v", primary)
+	}
+	if crash.Temperature != 1 || crash.EndTemperature != nil || crash.Days != 1.5 {
+		t.Errorf("expected 1 °C for 1.5 days, got %+v", crash)
+	}
+
+	unsupported := []string{"final_gravity in kg", "fermentation_steps[2].start_temperature in K"}
+	if !reflect.DeepEqual(recipe.Unsupported, unsupported) {
+		t.Errorf("expected %v unsupported, got %v", unsupported, recipe.Unsupported)
+	}
+}
+
+func TestParseBeerXML(t *testing.T) {
+	tests := []struct {
+		name        string
+		stages      string
+		steps       []FermentationStep
+		unsupported []string
+	}{
+		{
+			"all stages",
+			"<PRIMARY_AGE>7</PRIMARY_AGE><PRIMARY_TEMP>19</PRIMARY_TEMP><SECONDARY_AGE>3</SECONDARY_AGE><SECONDARY_TEMP>21</SECONDARY_TEMP><AGE>14</AGE><AGE_TEMP>2</AGE_TEMP>",
+			[]FermentationStep{{Name: "Primary", Temperature: 19, Days: 7}, {Name: "Secondary", Temperature: 21, Days: 3}, {Name: "Aging", Temperature: 2, Days: 14}},
+			nil,
+		},
+		{
+			"stage beyond FERMENTATION_STAGES",
+			"<FERMENTATION_STAGES>2</FERMENTATION_STAGES><PRIMARY_TEMP>19</PRIMARY_TEMP><SECONDARY_TEMP>21</SECONDARY_TEMP><TERTIARY_TEMP>5</TERTIARY_TEMP>",
+			[]FermentationStep{{Name: "Primary", Temperature: 19}, {Name: "Secondary", Temperature: 21}},
+			[]string{"TERTIARY stage beyond FERMENTATION_STAGES"},
+		},
+		{
+			"age without temperature",
+			"<PRIMARY_TEMP>19</PRIMARY_TEMP><SECONDARY_AGE>3</SECONDARY_AGE><AGE>14</AGE>",
+			[]FermentationStep{{Name: "Primary", Temperature: 19}},
+			[]string{"SECONDARY_AGE without SECONDARY_TEMP", "AGE without AGE_TEMP"},
+		},
+		{
+			"aging temperature without age",
+			"<AGE_TEMP>2</AGE_TEMP>",
+			nil,
+			[]string{"AGE_TEMP without AGE"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recipe, err := parseBeerXML([]byte("<RECIPES><RECIPE><NAME>Pils</NAME>" + test.stages + "</RECIPE></RECIPES>"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(recipe.Steps, test.steps) {
+				t.Errorf("expected steps %+v, got %+v", test.steps, recipe.Steps)
+			}
+			if !reflect.DeepEqual(recipe.Unsupported, test.unsupported) {
+				t.Errorf("expected %v unsupported, got %v", test.unsupported, recipe.Unsupported)
+			}
+		})
+	}
+}
+
+func TestApplyRecipe(t *testing.T) {
+	og, end := 1.050, 15.0
+	recipe := Recipe{
+		OG:    &og,
+		Steps: []FermentationStep{{Name: "Primary", Temperature: 10, EndTemperature: &end, Days: 14}},
+	}
+
+	tests := []struct {
+		name      string
+		plot      Plot
+		og        float64
+		min, max  float64
+		stepStart float64
+	}{
+		{"sg and Celsius", Plot{GravityUnit: "sg", TemperatureUnit: "C"}, 1.050, 10, 15, 10},
+		{"points and Fahrenheit", Plot{GravityUnit: "points", TemperatureUnit: "F"}, 1050, 50, 59, 50},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plot := test.plot
+			recipe.apply(&plot)
+			if !approximately(plot.TargetOG, test.og) {
+				t.Errorf("expected target OG %v, got %v", test.og, plot.TargetOG)
+			}
+			if !approximately(plot.TargetTempMin, test.min) || !approximately(plot.TargetTempMax, test.max) {
+				t.Errorf("expected targets %v to %v, got %v to %v", test.min, test.max, plot.TargetTempMin, plot.TargetTempMax)
+			}
+			if !approximately(&plot.FermentationSteps[0].Temperature, test.stepStart) {
+				t.Errorf("expected step at %v, got %+v", test.stepStart, plot.FermentationSteps[0])
+			}
+		})
+	}
+
+	if recipe.Steps[0].Temperature != 10 || *recipe.Steps[0].EndTemperature != 15 {
+		t.Errorf("expected the recipe to be left in Celsius, got %+v", recipe.Steps[0])
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const (
+	defaultSmoothingWindow = 5
+	maxSmoothingWindow     = 101
+)
+
+type Smoothing string
+
+const (
+	NoSmoothing          Smoothing = ""
+	MovingAverage        Smoothing = "moving_average"
+	ExponentialSmoothing Smoothing = "exponential"
+	SavitzkyGolay        Smoothing = "savitzky_golay"
+)
+
+type SmoothingOptions struct {
+	Method Smoothing
+	Window int
+}
+
+func parseSmoothing(r *http.Request) (SmoothingOptions, error) {
+	options := SmoothingOptions{Method: Smoothing(r.URL.Query().Get("smooth")), Window: defaultSmoothingWindow}
+	switch options.Method {
+	case NoSmoothing, MovingAverage, ExponentialSmoothing, SavitzkyGolay:
+	default:
+		return options, errors.New("Invalid smoothing: should be moving_average, exponential or savitzky_golay")
+	}
+
+	if val := r.URL.Query().Get("window"); val != "" {
+		window, err := strconv.Atoi(val)
+		if err != nil || window < 2 || window > maxSmoothingWindow {
+			return options, errors.New("Invalid window: must be between 2 and 101 readings")
+		}
+		options.Window = window
+	}
+	if options.Method == SavitzkyGolay && options.Window%2 == 0 {
+		return options, errors.New("Invalid window: must be odd for savitzky_golay")
+	}
+	return options, nil
+}
+
+// Centered moving average, with the window shrinking at the ends of the
+// series so that they are not pulled towards their neighbours.
+func movingAverage(values []float64, window int) []float64 {
+	smoothed := make([]float64, len(values))
+	// Even windows take the extra reading before the current one
+	before, after := window/2, (window-1)/2
+	for i := range values {
+		edge := i
+		if len(values)-1-i < edge {
+			edge = len(values) - 1 - i
+		}
+		from, to := i-before, i+after
+		if edge < before {
+			from = i - edge
+		}
+		if edge < after {
+			to = i + edge
+		}
+
+		sum := 0.0
+		for _, value := range values[from : to+1] {
+			sum += value
+		}
+		smoothed[i] = sum / float64(to-from+1)
+	}
+	return smoothed
+}
+
+// Exponential moving average, with the smoothing factor of a moving
+// average of the same window.
+func exponentialSmoothing(values []float64, window int) []float64 {
+	smoothed := make([]float64, len(values))
+	alpha := 2 / float64(window+1)
+	for i, value := range values {
+		if i == 0 {
+			smoothed[i] = value
+		} else {
+			smoothed[i] = alpha*value + (1-alpha)*smoothed[i-1]
+		}
+	}
+	return smoothed
+}
+
+// Savitzky-Golay filter fitting a quadratic over the window, which follows
+// the curve of a fermentation better than an average. Near the ends of the
+// series the window shrinks to the readings available on both sides.
+func savitzkyGolay(values []float64, window int) []float64 {
+	smoothed := make([]float64, len(values))
+	half := window / 2
+	for i := range values {
+		m := half
+		if i < m {
+			m = i
+		}
+		if len(values)-1-i < m {
+			m = len(values) - 1 - i
+		}
+		// A quadratic through three readings or fewer is the reading itself
+		if m < 2 {
+			smoothed[i] = values[i]
+			continue
+		}
+
+		mf := float64(m)
+		norm := (2*mf + 3) * (2*mf + 1) * (2*mf - 1) / 3
+		sum := 0.0
+		for j := -m; j <= m; j++ {
+			coefficient := 3*mf*mf + 3*mf - 1 - 5*float64(j*j)
+			sum += coefficient * values[i+j]
+		}
+		smoothed[i] = sum / norm
+	}
+	return smoothed
+}
+
+// Smooth each instrument of the measurements separately, in time order.
+// Timestamps are kept, so smoothing composes with the resolution of the
+// data.
+func smoothMeasurements(measurements []Measurement, options SmoothingOptions) []Measurement {
+	if options.Method == NoSmoothing || len(measurements) == 0 {
+		return measurements
+	}
+
+	sorted := append([]Measurement{}, measurements...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Key != sorted[j].Key {
+			return sorted[i].Key < sorted[j].Key
+		}
+		return sorted[i].Timestamp.Before(sorted[j].Timestamp.Time)
+	})
+
+	for start := 0; start < len(sorted); {
+		end := start
+		for end < len(sorted) && sorted[end].Key == sorted[start].Key {
+			end++
+		}
+
+		values := make([]float64, end-start)
+		for i := range values {
+			values[i] = sorted[start+i].Value
+		}
+
+		var smoothed []float64
+		switch options.Method {
+		case MovingAverage:
+			smoothed = movingAverage(values, options.Window)
+		case ExponentialSmoothing:
+			smoothed = exponentialSmoothing(values, options.Window)
+		case SavitzkyGolay:
+			smoothed = savitzkyGolay(values, options.Window)
+		}
+		for i, value := range smoothed {
+			sorted[start+i].Value = value
+		}
+		start = end
+	}
+	return sorted
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func closeTo(a []float64, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if math.Abs(a[i]-b[i]) > 1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSmoothing(t *testing.T) {
+	linear := []float64{1, 2, 3, 4, 5, 6, 7, 8}
+	quadratic := []float64{}
+	for i := 0; i < 9; i++ {
+		quadratic = append(quadratic, 20-0.5*float64(i)+0.1*float64(i*i))
+	}
+
+	tests := []struct {
+		name     string
+		smooth   func([]float64, int) []float64
+		values   []float64
+		window   int
+		smoothed []float64
+	}{
+		{"moving average of linear series", movingAverage, linear, 5, linear},
+		{"moving average edges", movingAverage, []float64{9, 0, 0, 0, 9}, 3, []float64{9, 3, 0, 3, 9}},
+		{"moving average even window", movingAverage, []float64{1, 2, 3, 4, 5, 6}, 4, []float64{1, 2, 2.5, 3.5, 5, 6}},
+		{"moving average window beyond series", movingAverage, []float64{1, 2, 6}, 11, []float64{1, 3, 6}},
+		{"exponential", exponentialSmoothing, []float64{0, 10, 10}, 3, []float64{0, 5, 7.5}},
+		{"savitzky-golay of linear series", savitzkyGolay, linear, 5, linear},
+		{"savitzky-golay of quadratic series", savitzkyGolay, quadratic, 7, quadratic},
+		// Readings next to the ends have too few neighbours for a quadratic
+		// and are kept, further in the window shrinks to fit
+		{"savitzky-golay edges", savitzkyGolay, []float64{0, 0, 0, 10, 0, 0, 0}, 7, []float64{0, 0, 24.0 / 7, 10.0 / 3, 24.0 / 7, 0, 0}},
+		{"savitzky-golay short series", savitzkyGolay, []float64{1, 5, 2}, 5, []float64{1, 5, 2}},
+		{"empty series", savitzkyGolay, []float64{}, 5, []float64{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			smoothed := test.smooth(test.values, test.window)
+			if !closeTo(smoothed, test.smoothed) {
+				t.Errorf("expected %v, got %v", test.smoothed, smoothed)
+			}
+		})
+	}
+}
+
+func TestSmoothMeasurements(t *testing.T) {
+	start := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	measurement := func(key string, minutes int, value float64) Measurement {
+		return Measurement{Key: key, Timestamp: Timestamp{start.Add(time.Duration(minutes) * time.Minute)}, Value: value}
+	}
+	measurements := []Measurement{
+		measurement("b", 2, 100),
+		measurement("a", 1, 3),
+		measurement("b", 0, 0),
+		measurement("a", 0, 0),
+		measurement("a", 2, 6),
+		measurement("b", 1, 80),
+	}
+
+	smoothed := smoothMeasurements(measurements, SmoothingOptions{Method: MovingAverage, Window: 3})
+	expected := []Measurement{
+		measurement("a", 0, 0),
+		measurement("a", 1, 3),
+		measurement("a", 2, 6),
+		measurement("b", 0, 0),
+		measurement("b", 1, 60),
+		measurement("b", 2, 100),
+	}
+	if len(smoothed) != len(expected) {
+		t.Fatalf("expected %d measurements, got %d", len(expected), len(smoothed))
+	}
+	for i := range expected {
+		if smoothed[i].Key != expected[i].Key || !smoothed[i].Timestamp.Equal(expected[i].Timestamp.Time) || smoothed[i].Value != expected[i].Value {
+			t.Errorf("expected %+v at %d, got %+v", expected[i], i, smoothed[i])
+		}
+	}
+	if measurements[0].Key != "b" || measurements[0].Value != 100 {
+		t.Errorf("expected the measurements to be left unchanged, got %+v", measurements[0])
+	}
+
+	unsmoothed := smoothMeasurements(measurements, SmoothingOptions{Method: NoSmoothing})
+	if &unsmoothed[0] != &measurements[0] {
+		t.Error("expected the measurements without smoothing")
+	}
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"database/sql/driver"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/lib/pq"
+	"path"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,9 +21,159 @@ type PlotData struct {
 	Values map[string]float64 `json:"values"`
 }
 
+// Data with the annotations or excluded readings in the same time window,
+// returned when asked for with ?annotations=true or ?include_excluded=true.
+// Only the lists asked for are included, even when they are empty.
+type PlotDataResponse struct {
+	Data        []PlotData         `json:"data"`
+	Annotations *[]Annotation      `json:"annotations,omitempty"`
+	Excluded    *[]ExcludedReading `json:"excluded,omitempty"`
+}
+
+// A reading left out of plot data, either flagged as an outlier or
+// excluded by hand.
+type ExcludedReading struct {
+	Key       string    `db:"key" json:"key"`
+	Timestamp time.Time `db:"timestamp" json:"timestamp"`
+	Value     float64   `db:"value" json:"value"`
+	Reason    string    `db:"reason" json:"reason"`
+}
+
+// A stored measurement of a user, with its id for corrections.
+type RawMeasurement struct {
+	Id        int64     `db:"id" json:"id"`
+	Key       string    `db:"key" json:"key"`
+	Timestamp time.Time `db:"timestamp" json:"timestamp"`
+	Value     float64   `db:"value" json:"value"`
+	Excluded  bool      `db:"excluded" json:"excluded"`
+}
+
+// A correction or deletion of a measurement.
+type MeasurementAudit struct {
+	Id            int64     `db:"id" json:"id"`
+	MeasurementId int64     `db:"measurement_id" json:"measurementId"`
+	Login         string    `db:"login" json:"login"`
+	Key           string    `db:"key" json:"key"`
+	Timestamp     time.Time `db:"timestamp" json:"timestamp"`
+	Action        string    `db:"action" json:"action"`
+	OldValue      float64   `db:"old_value" json:"oldValue"`
+	NewValue      *float64  `db:"new_value" json:"newValue"`
+	ChangedAt     time.Time `db:"changed_at" json:"changedAt"`
+}
+
+// Identifies a reading of a plot by key and time, as in plot data.
+type ReadingRef struct {
+	Key       string    `json:"key"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type Reading struct {
+	Id              int64   `db:"id"`
+	Key             string  `db:"key"`
+	Value           float64 `db:"value"`
+	ExclusionReason *string `db:"exclusion_reason"`
+}
+
+// An event on the timeline of a plot, such as pitching yeast. Annotations
+// with an end time cover a period, like a cold crash.
+type Annotation struct {
+	Id        int        `db:"id" json:"id"`
+	PlotId    int        `db:"plot_id" json:"-"`
+	Timestamp time.Time  `db:"timestamp" json:"timestamp"`
+	EndTime   *time.Time `db:"end_time" json:"endTime,omitempty"`
+	Text      string     `db:"text" json:"text"`
+	Category  string     `db:"category" json:"category,omitempty"`
+	ImageUrl  string     `db:"image_url" json:"imageUrl,omitempty"`
+}
+
+// Statistics of one instrument over the plot window. The expected interval
+// between readings is in seconds.
+type InstrumentSummary struct {
+	Key              string     `db:"key" json:"key"`
+	Name             string     `db:"name" json:"name"`
+	Type             string     `db:"type" json:"type"`
+	Count            int        `db:"count" json:"count"`
+	Min              *float64   `db:"min" json:"min"`
+	Max              *float64   `db:"max" json:"max"`
+	Mean             *float64   `db:"mean" json:"mean"`
+	StdDev           *float64   `db:"stddev" json:"stddev"`
+	FirstValue       *float64   `db:"first_value" json:"firstValue"`
+	LastValue        *float64   `db:"last_value" json:"lastValue"`
+	FirstReading     *time.Time `db:"first_reading" json:"firstReading"`
+	LastReading      *time.Time `db:"last_reading" json:"lastReading"`
+	ExpectedInterval *float64   `db:"expected_interval" json:"expectedInterval"`
+	ReceivedPercent  *float64   `db:"received_percent" json:"receivedPercent"`
+}
+
+// A measurement placed on the time axis of its plot, in hours since the
+// plot started.
+type RelativeMeasurement struct {
+	PlotId int     `db:"plot_id"`
+	Name   string  `db:"name"`
+	Key    string  `db:"key"`
+	Hours  float64 `db:"hours"`
+	Value  float64 `db:"value"`
+}
+
+type RelativePoint struct {
+	Hours float64 `json:"hours"`
+	Value float64 `json:"value"`
+}
+
+// The series of one instrument when comparing plots.
+type ComparedSeries struct {
+	PlotId int             `json:"plotId"`
+	Name   string          `json:"name"`
+	Key    string          `json:"key"`
+	Points []RelativePoint `json:"points"`
+}
+
 type ShareLink struct {
-	PlotId int    `db:"plot_id" json:"-"`
-	Uuid   string `json:"uuid"`
+	PlotId       int        `db:"plot_id" json:"-"`
+	Uuid         string     `json:"uuid"`
+	Label        string     `db:"label" json:"label"`
+	ExpiresAt    *time.Time `db:"expires_at" json:"expiresAt,omitempty"`
+	WindowStart  *time.Time `db:"window_start" json:"windowStart,omitempty"`
+	WindowEnd    *time.Time `db:"window_end" json:"windowEnd,omitempty"`
+	CreatedAt    time.Time  `db:"created_at" json:"createdAt"`
+	Views        int        `db:"views" json:"views"`
+	DataRequests int        `db:"data_requests" json:"dataRequests"`
+	LastAccessed *time.Time `db:"last_accessed" json:"lastAccessed,omitempty"`
+	PasswordHash *string    `db:"password_hash" json:"-"`
+	Protected    bool       `db:"protected" json:"protected"`
+	Password     string     `db:"-" json:"password,omitempty"`
+}
+
+// The part of a plot visible through a share link. Nil means unbounded.
+type TimeWindow struct {
+	Start *time.Time
+	End   *time.Time
+}
+
+func (shareLink *ShareLink) window() TimeWindow {
+	return TimeWindow{Start: shareLink.WindowStart, End: shareLink.WindowEnd}
+}
+
+func (window TimeWindow) clamp(start time.Time, end time.Time) (time.Time, time.Time) {
+	if window.Start != nil && start.Before(*window.Start) {
+		start = *window.Start
+	}
+	if window.End != nil && end.After(*window.End) {
+		end = *window.End
+	}
+	return start, end
+}
+
+// Limit the start and end time of a plot to the window. A plot is no
+// longer active once the window has ended.
+func (window TimeWindow) clampPlot(plot *Plot) {
+	if window.Start != nil && plot.StartTime.Before(*window.Start) {
+		plot.StartTime = *window.Start
+	}
+	if window.End != nil && (plot.EndTime == nil || plot.EndTime.After(*window.End)) {
+		plot.EndTime = window.End
+	}
+	plot.Active = plot.Active && (plot.EndTime == nil || plot.EndTime.After(time.Now()))
 }
 
 func (t *Timestamp) MarshalJSON() ([]byte, error) {
@@ -55,31 +209,353 @@ func (isotime *Timestamp) Scan(src interface{}) error {
 }
 
 type Measurement struct {
-	Key       string    `db:"key"`
-	Timestamp Timestamp `db:"timestamp"`
-	Value     float64   `db:"value"`
-	Login     string    `db:"login"`
+	Key            string    `db:"key"`
+	Timestamp      Timestamp `db:"timestamp"`
+	Value          float64   `db:"value"`
+	Login          string    `db:"login"`
+	OrganizationId *int      `db:"organization_id" json:"-"`
 }
 
 type Instrument struct {
-	Id   int    `db:"id" json:"-"`
+	Id   int    `db:"id" json:"id"`
 	Name string `db:"name" json:"name"`
 	Type string `db:"type" json:"type"`
 	Key  string `db:"key" json:"key"`
 	Plot int    `db:"plot" json:"-"`
 }
 
+// A measurement key a user has been sending, whether or not it is part of
+// a plot.
+type DiscoveredInstrument struct {
+	Key       string    `db:"key" json:"key"`
+	FirstSeen time.Time `db:"first_seen" json:"firstSeen"`
+	LastSeen  time.Time `db:"last_seen" json:"lastSeen"`
+	Count     int       `db:"count" json:"count"`
+	LastValue float64   `db:"last_value" json:"lastValue"`
+	Type      string    `db:"-" json:"type"`
+	InUse     bool      `db:"in_use" json:"inUse"`
+}
+
+type AutoPlotRule struct {
+	Enabled      bool   `db:"enabled" json:"enabled"`
+	NameTemplate string `db:"name_template" json:"nameTemplate"`
+}
+
+type Notification struct {
+	Id        int       `db:"id" json:"id"`
+	Message   string    `db:"message" json:"message"`
+	PlotId    *int      `db:"plot_id" json:"plotId,omitempty"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+	Read      bool      `db:"read" json:"read"`
+}
+
+// When to end a plot automatically. A nil field disables that condition.
+// The tolerance is in the unit of the gravity series.
+type AutoClosePolicy struct {
+	StableHours *int     `db:"auto_close_stable_hours" json:"stableHours,omitempty"`
+	Tolerance   *float64 `db:"auto_close_tolerance" json:"tolerance,omitempty"`
+	IdleDays    *int     `db:"auto_close_idle_days" json:"idleDays,omitempty"`
+}
+
+// An active plot with an auto close policy. Login is notified when the plot
+// ends, the owner or the creator of an organization plot.
+type AutoClosePlot struct {
+	Id    int    `db:"id"`
+	Name  string `db:"name"`
+	Login string `db:"login"`
+	AutoClosePolicy
+}
+
+// Recent readings of a plot, used to decide whether it has ended.
+type PlotActivity struct {
+	LastReading  *time.Time `db:"last_reading"`
+	IdleSeconds  *float64   `db:"idle_seconds"`
+	FirstGravity *time.Time `db:"first_gravity"`
+	LastGravity  *time.Time `db:"last_gravity"`
+	GravityRange *float64   `db:"gravity_range"`
+}
+
 type Plot struct {
-	Id          int          `db:"id" json:"id"`
-	Name        string       `db:"name" json:"name"`
-	StartTime   time.Time    `db:"start_time" json:"startTime"`
-	EndTime     *time.Time   `db:"end_time" json:"endTime,omitempty"`
-	Instruments []Instrument `json:"instruments,omitempty"`
-	Login       string       `db:"login" json:"-"`
-	Active      bool         `db:"active" json:"active"`
-	ShareLink   *string      `json:"sharelink,omitempty"`
+	Id             int          `db:"id" json:"id"`
+	Name           string       `db:"name" json:"name"`
+	StartTime      time.Time    `db:"start_time" json:"startTime"`
+	EndTime        *time.Time   `db:"end_time" json:"endTime,omitempty"`
+	Instruments    []Instrument `json:"instruments,omitempty"`
+	Login          string       `db:"login" json:"-"`
+	Active         bool         `db:"active" json:"active"`
+	ShareLink      *string      `json:"sharelink,omitempty"`
+	Role           Role         `db:"role" json:"role,omitempty"`
+	OrganizationId *int         `db:"organization_id" json:"organizationId,omitempty"`
+	Archived       bool         `db:"archived" json:"archived"`
+	Annotations    []Annotation `json:"annotations,omitempty"`
+
+	// Batch metadata. Target gravity is in the gravity unit of the plot, sg
+	// (1.050) or points (1050), and target temperature in its temperature
+	// unit, C or F. The units should match those of the plot's series.
+	Style           string         `db:"style" json:"style,omitempty"`
+	Recipe          string         `db:"recipe" json:"recipe,omitempty"`
+	BatchSize       *float64       `db:"batch_size" json:"batchSize,omitempty"`
+	Yeast           string         `db:"yeast" json:"yeast,omitempty"`
+	TargetOG        *float64       `db:"target_og" json:"targetOg,omitempty"`
+	TargetFG        *float64       `db:"target_fg" json:"targetFg,omitempty"`
+	TargetTempMin   *float64       `db:"target_temp_min" json:"targetTempMin,omitempty"`
+	TargetTempMax   *float64       `db:"target_temp_max" json:"targetTempMax,omitempty"`
+	Tags            pq.StringArray `db:"tags" json:"tags"`
+	GravityUnit     string         `db:"gravity_unit" json:"gravityUnit"`
+	TemperatureUnit string         `db:"temperature_unit" json:"temperatureUnit"`
+
+	FermentationSteps []FermentationStep `json:"fermentationSteps,omitempty"`
+}
+
+// A step of the fermentation schedule, which is also the temperature
+// profile of the plot. A step ramps from the previous target to its
+// temperature over RampHours, and then holds it for Days, or ramps on to
+// the end temperature if it has one. Temperatures are in the temperature
+// unit of the plot.
+type FermentationStep struct {
+	Name           string   `db:"name" json:"name"`
+	Temperature    float64  `db:"temperature" json:"temperature"`
+	EndTemperature *float64 `db:"end_temperature" json:"endTemperature,omitempty"`
+	RampHours      float64  `db:"ramp_hours" json:"rampHours,omitempty"`
+	Days           float64  `db:"days" json:"days"`
+}
+
+// The target temperature of a plot at a time, for fermentation controllers,
+// in the temperature unit of the plot.
+type Setpoint struct {
+	PlotId     int        `json:"plotId"`
+	Target     float64    `json:"target"`
+	Unit       string     `json:"unit"`
+	Step       int        `json:"step"`
+	StepName   string     `json:"stepName,omitempty"`
+	Ramping    bool       `json:"ramping"`
+	NextChange *time.Time `json:"nextChange,omitempty"`
+	NextTarget *float64   `json:"nextTarget,omitempty"`
+}
+
+type RecipeImportReport struct {
+	Plot        Plot     `json:"plot"`
+	Imported    []string `json:"imported"`
+	Unsupported []string `json:"unsupported"`
+}
+
+type PlotFilter struct {
+	OrganizationId *int
+	Archived       bool
+	Tags           pq.StringArray
+	Style          string
 }
 
 type User struct {
 	Key string `json:"key"`
 }
+
+type ApiKey struct {
+	Id                 int            `db:"id" json:"id"`
+	Key                string         `db:"key" json:"key"`
+	Name               string         `db:"name" json:"name"`
+	Login              string         `db:"login" json:"-"`
+	Write              bool           `db:"write" json:"write"`
+	InstrumentPatterns pq.StringArray `db:"instrument_patterns" json:"instrumentPatterns"`
+	ReadPlots          pq.Int64Array  `db:"read_plots" json:"readPlots"`
+	OrganizationId     *int           `db:"organization_id" json:"organizationId,omitempty"`
+}
+
+// An empty pattern list means that the key may write to any instrument.
+func (k *ApiKey) allowsInstrument(instrumentKey string) bool {
+	if len(k.InstrumentPatterns) == 0 {
+		return true
+	}
+	for _, pattern := range k.InstrumentPatterns {
+		if matched, _ := path.Match(pattern, instrumentKey); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *ApiKey) allowsReadingPlot(plotId int) bool {
+	for _, id := range k.ReadPlots {
+		if int(id) == plotId {
+			return true
+		}
+	}
+	return false
+}
+
+type RejectedMeasurement struct {
+	Key       string    `json:"key"`
+	Timestamp Timestamp `json:"timestamp"`
+	Reason    string    `json:"reason"`
+}
+
+type ScopeReport struct {
+	Error    string                `json:"error"`
+	Rejected []RejectedMeasurement `json:"rejected"`
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Lists every problem found in a rejected request. It is an error, so
+// that parsers can return it like any other error.
+type ValidationReport struct {
+	Message  string       `json:"error"`
+	Problems []FieldError `json:"problems"`
+}
+
+func (report *ValidationReport) add(field string, message string) {
+	report.Problems = append(report.Problems, FieldError{Field: field, Message: message})
+}
+
+func (report *ValidationReport) Error() string {
+	messages := []string{}
+	for _, problem := range report.Problems {
+		messages = append(messages, problem.Field+": "+problem.Message)
+	}
+	return report.Message + ": " + strings.Join(messages, ", ")
+}
+
+type DeviceAuthorization struct {
+	UserCode   string  `db:"user_code" json:"userCode"`
+	DeviceName string  `db:"device_name" json:"deviceName"`
+	Login      *string `db:"login" json:"-"`
+	Status     string  `db:"status" json:"status"`
+	Expired    bool    `db:"expired" json:"-"`
+	TooFast    bool    `db:"too_fast" json:"-"`
+}
+
+// Role of a user on a plot. Each role includes the rights of the ones
+// before it.
+type Role int
+
+const (
+	NoRole Role = iota
+	Viewer
+	Editor
+	Owner
+)
+
+func (role Role) ToString() (string, error) {
+	switch role {
+	case NoRole:
+		return "", nil
+	case Viewer:
+		return "viewer", nil
+	case Editor:
+		return "editor", nil
+	case Owner:
+		return "owner", nil
+	default:
+		return "", errors.New("Unknown role")
+	}
+}
+
+func (role Role) String() string {
+	str, _ := role.ToString()
+	return str
+}
+
+func RoleFromString(roleString string) (Role, error) {
+	switch strings.ToLower(roleString) {
+	case "viewer":
+		return Viewer, nil
+	case "editor":
+		return Editor, nil
+	case "owner":
+		return Owner, nil
+	default:
+		return NoRole, errors.New("Unknown role from string: " + roleString)
+	}
+}
+
+func (role Role) MarshalJSON() ([]byte, error) {
+	str, err := role.ToString()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(str)
+}
+
+func (role *Role) UnmarshalJSON(b []byte) error {
+	var str string
+	err := json.Unmarshal(b, &str)
+	if err != nil {
+		return err
+	}
+	*role, err = RoleFromString(str)
+	return err
+}
+
+func (role Role) Value() (driver.Value, error) {
+	return role.ToString()
+}
+
+func (role *Role) Scan(src interface{}) error {
+	var err error
+	switch src := src.(type) {
+	case string:
+		*role, err = RoleFromString(src)
+	case []byte:
+		*role, err = RoleFromString(string(src))
+	default:
+		err = errors.New("Incompatible type for Role")
+	}
+	return err
+}
+
+// What gives one user a role on a plot.
+type PlotAccess struct {
+	Login            *string `db:"login"`
+	OrganizationId   *int    `db:"organization_id"`
+	MemberRole       *Role   `db:"member_role"`
+	OrganizationRole *Role   `db:"organization_role"`
+}
+
+// The user that created a personal plot is always its owner, others get
+// their role from the plot membership or from the organization owning the
+// plot. An organization plot belongs to the organization alone, so its
+// creator loses access when leaving the organization.
+func (access PlotAccess) role(user string) Role {
+	role := NoRole
+	if access.OrganizationId == nil && access.Login != nil && *access.Login == user {
+		role = Owner
+	}
+	for _, r := range []*Role{access.MemberRole, access.OrganizationRole} {
+		if r != nil && *r > role {
+			role = *r
+		}
+	}
+	return role
+}
+
+type PlotMember struct {
+	Login string `db:"login" json:"id"`
+	Name  string `db:"name" json:"name"`
+	Email string `db:"email" json:"email"`
+	Role  Role   `db:"role" json:"role"`
+}
+
+type PlotInvitation struct {
+	Id        int       `db:"id" json:"id"`
+	PlotId    int       `db:"plot_id" json:"plotId"`
+	PlotName  string    `db:"plot_name" json:"plotName,omitempty"`
+	Email     string    `db:"email" json:"email"`
+	Role      Role      `db:"role" json:"role"`
+	InvitedBy string    `db:"invited_by" json:"-"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+type Organization struct {
+	Id        int       `db:"id" json:"id"`
+	Name      string    `db:"name" json:"name"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+	Role      Role      `db:"role" json:"role,omitempty"`
+}
+
+type OrganizationMemberRequest struct {
+	Email string `json:"email"`
+	Role  Role   `json:"role"`
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/patrickmn/go-cache"
+	"golang.org/x/crypto/bcrypt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	viewerTokenLifetime = time.Hour
+	maxUnlockAttempts   = 10
+	unlockLockout       = 15 * time.Minute
+)
+
+// Failed unlock attempts per client and share link, so that guessing from
+// one client does not lock out the other viewers of a link.
+var unlockAttempts = cache.New(unlockLockout, 10*time.Minute)
+
+type UnlockRequest struct {
+	Password string `json:"password"`
+}
+
+type ViewerToken struct {
+	Token     string `json:"token"`
+	ExpiresIn int    `json:"expiresIn"`
+}
+
+// Secret for signing viewer tokens. Without SHARE_TOKEN_SECRET a random
+// secret is used, and viewers have to unlock again after a restart.
+func viewerTokenSecret() ([]byte, error) {
+	if secret := os.Getenv("SHARE_TOKEN_SECRET"); secret != "" {
+		return []byte(secret), nil
+	}
+
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	return secret, err
+}
+
+// Addresses of the proxies in front of the server, from TRUSTED_PROXIES,
+// whose X-Forwarded-For headers are trusted.
+func trustedProxies() map[string]bool {
+	proxies := map[string]bool{}
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies[proxy] = true
+		}
+	}
+	return proxies
+}
+
+// The address of the client. Behind trusted proxies it is the last address
+// in X-Forwarded-For that was not added by one of them, as earlier entries
+// can be set by the client.
+func (env *Env) clientAddress(r *http.Request) string {
+	address, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		address = r.RemoteAddr
+	}
+
+	if !env.trustedProxies[address] {
+		return address
+	}
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			continue
+		}
+		address = hop
+		if !env.trustedProxies[hop] {
+			break
+		}
+	}
+	return address
+}
+
+// Count an unlock attempt before checking it, so that concurrent guesses
+// can not get past the limit. Returns false once the limit is reached.
+func reserveUnlockAttempt(key string) bool {
+	if unlockAttempts.Add(key, 1, cache.DefaultExpiration) == nil {
+		return true
+	}
+	attempts, err := unlockAttempts.IncrementInt(key, 1)
+	if err != nil {
+		// Expired in between
+		return unlockAttempts.Add(key, 1, cache.DefaultExpiration) == nil
+	}
+	return attempts <= maxUnlockAttempts
+}
+
+func hashSharePassword(password string) (*string, error) {
+	if len(password) < minPasswordLength {
+		return nil, errors.New("Invalid share link: password must be at least 8 characters.")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	passwordHash := string(hash)
+	return &passwordHash, nil
+}
+
+func (env *Env) issueViewerToken(shareLink *ShareLink) (string, error) {
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": shareLink.Uuid,
+		"iat": now.Unix(),
+		"exp": now.Add(viewerTokenLifetime).Unix(),
+	})
+	return token.SignedString(env.viewerSecret)
+}
+
+func (env *Env) checkViewerToken(r *http.Request, shareLink *ShareLink) bool {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+
+	token, err := jwt.Parse(strings.TrimPrefix(header, "Bearer "), func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, errors.New("Unexpected signing method")
+		}
+		return env.viewerSecret, nil
+	})
+	if err != nil || !token.Valid {
+		return false
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	return ok && claims["sub"] == shareLink.Uuid
+}
+
+// Check that the request may view a share link, writing an error response
+// if not. Links without a password are open to everyone.
+func (env *Env) checkViewerAccess(w http.ResponseWriter, r *http.Request, shareLink *ShareLink) bool {
+	if !shareLink.Protected || env.checkViewerToken(r, shareLink) {
+		return true
+	}
+
+	http.Error(w, "Share link is password protected", http.StatusUnauthorized)
+	return false
+}
+
+func (env *Env) unlockSharedPlot(w http.ResponseWriter, r *http.Request) {
+	shareLink, err := env.getShareLinkFromUuid(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if shareLink == nil {
+		http.Error(w, "No plot found for share link",
+			http.StatusNotFound)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var request UnlockRequest
+	err = decoder.Decode(&request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if shareLink.Protected {
+		client := env.clientAddress(r)
+		attemptKey := client + "#" + shareLink.Uuid
+		if !reserveUnlockAttempt(attemptKey) {
+			http.Error(w, "Too many failed attempts, try again later", http.StatusTooManyRequests)
+			return
+		}
+
+		err = bcrypt.CompareHashAndPassword([]byte(*shareLink.PasswordHash), []byte(request.Password))
+		if err != nil {
+			log.WithFields(log.Fields{"uuid": shareLink.Uuid, "client": client}).Warn("Failed to unlock share link")
+			http.Error(w, "Invalid password", http.StatusUnauthorized)
+			return
+		}
+		unlockAttempts.DecrementInt(attemptKey, 1)
+	}
+
+	token, err := env.issueViewerToken(shareLink)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, _ := json.Marshal(ViewerToken{
+		Token:     token,
+		ExpiresIn: int(viewerTokenLifetime.Seconds()),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}